@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/collector"
+	"github.com/tynany/servertech_exporter/config"
+	"github.com/tynany/servertech_exporter/influx"
+	"gopkg.in/yaml.v2"
+)
+
+// scrapeTarget is a target to scrape, with the credentials, module and labels from its configuration file entry.
+type scrapeTarget struct {
+	target, user, pass string
+	module             *config.Module
+	labels             prometheus.Labels
+}
+
+// resolveTarget returns the target of the request's 'target', 'user', 'pass' and 'module' parameters. Credentials
+// not passed as parameters are taken from the configuration file as per config.Credentials, and the module if not
+// passed and labels from the target's configuration file entry.
+func resolveTarget(r *http.Request) (*scrapeTarget, error) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		return nil, fmt.Errorf("'target' parameter must be specified")
+	}
+	return resolveNamedTarget(r, target)
+}
+
+// resolveNamedTarget returns target, with the request's 'user', 'pass' and 'module' parameters resolved as per
+// resolveTarget.
+func resolveNamedTarget(r *http.Request, target string) (*scrapeTarget, error) {
+	t := &scrapeTarget{
+		target: target,
+		user:   r.URL.Query().Get("user"),
+		pass:   r.URL.Query().Get("pass"),
+	}
+
+	cfg := activeConfig.Load()
+	module, err := cfg.Module(r.URL.Query().Get("module"), t.target)
+	if err != nil {
+		return nil, err
+	}
+	t.module = module
+
+	if t.user == "" && t.pass == "" {
+		if t.user, t.pass, err = cfg.Credentials(t.target); err != nil {
+			return nil, err
+		}
+	}
+	if entry := cfg.Match(t.target); entry != nil {
+		t.labels = entry.Labels
+	}
+	return t, nil
+}
+
+// newExporter returns an exporter of the target, logging with the logger of r.
+func (t *scrapeTarget) newExporter(r *http.Request) *collector.Exporter {
+	e := collector.NewExporter(t.target, t.user, t.pass, t.module)
+	e.Logger = requestLogger(r)
+	return e
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("cannot write json response", "err", err)
+	}
+}
+
+func topologyHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := resolveTarget(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	topology, err := collector.GetTopology(requestLogger(r), t.target, t.user, t.pass)
+	if err != nil {
+		requestLogger(r).Error("topology failed", "target", t.target, "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, topology)
+}
+
+// readingsHandler returns the readings of a PDU, normalised to SI units, as JSON. Subsystems that cannot be read are
+// reported in the response's errors, which is a 502 if no subsystem could be read.
+func readingsHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := resolveTarget(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	readings := collector.GetReadings(requestLogger(r), t.target, t.user, t.pass, t.module)
+	status := http.StatusOK
+	if len(readings.Errors) > 0 && readings.System == nil && readings.Units == nil && readings.Cords == nil &&
+		readings.Lines == nil && readings.Phases == nil && readings.Branches == nil && readings.Ocps == nil && readings.Outlets == nil {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, readings)
+}
+
+// influxHandler returns the metrics of a PDU as InfluxDB line protocol.
+func influxHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := resolveTarget(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := prometheus.WrapRegistererWith(t.labels, registry).Register(t.newExporter(r)); err != nil {
+		requestLogger(r).Error("cannot register exporter", "target", t.target, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		requestLogger(r).Error("cannot gather metrics", "target", t.target, "err", err)
+	}
+	w.Header().Set("Content-Type", influx.ContentType)
+	if _, err := influx.Encode(w, families, time.Now()); err != nil {
+		requestLogger(r).Error("cannot write line protocol response", "target", t.target, "err", err)
+	}
+}
+
+// configHandler returns the loaded configuration file as YAML, with secrets redacted.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := yaml.Marshal(activeConfig.Load())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(out)
+}
+
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// sdHandler returns the named targets in the configuration file in the Prometheus HTTP service discovery format.
+func sdHandler(w http.ResponseWriter, r *http.Request) {
+	groups := []sdTargetGroup{}
+	if cfg := activeConfig.Load(); cfg != nil {
+		for _, t := range cfg.Targets {
+			if t.Name == "" {
+				continue
+			}
+			group := sdTargetGroup{Targets: []string{t.Name}, Labels: make(map[string]string, len(t.Labels)+1)}
+			for k, v := range t.Labels {
+				group.Labels[k] = v
+			}
+			if t.Module != "" {
+				group.Labels["__param_module"] = t.Module
+			}
+			groups = append(groups, group)
+		}
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/tynany/servertech_exporter/collector"
+	"github.com/tynany/servertech_exporter/config"
+)
+
+var (
+	checkCmd         = kingpin.Command("check", "Validate the configuration file and TLS files, optionally probe every named target, print a report and exit. Exits non-zero if any check fails.")
+	checkProbe       = checkCmd.Flag("probe", "Probe the system endpoint of every named target in the configuration file.").Default("False").Bool()
+	checkConcurrency = checkCmd.Flag("concurrency", "Maximum number of targets probed at once.").Default("10").Int()
+	checkFormat      = checkCmd.Flag("format", "Output format, one of: table, junit (JUnit XML).").Default("table").Enum("table", "junit")
+)
+
+// checkResult is the result of a single check.
+type checkResult struct {
+	suite, name string
+	// err is nil if the check passed.
+	err error
+	// kind of failure, or detail of the passed check.
+	detail   string
+	duration time.Duration
+}
+
+// runCheck runs the checks of the check command, prints a report to stdout, and returns the exit code.
+func runCheck() int {
+	var results []checkResult
+
+	start := time.Now()
+	var (
+		cfg *config.Config
+		err error
+	)
+	if *configFile == "" {
+		err = fmt.Errorf("--config.file not specified")
+	} else {
+		cfg, err = config.Load(*configFile)
+	}
+	results = append(results, checkResult{suite: "config", name: *configFile, err: err, duration: time.Since(start)})
+	results = append(results, checkTLSFiles()...)
+
+	if *checkProbe && cfg != nil {
+		results = append(results, probeTargets(cfg, *checkConcurrency)...)
+	}
+
+	switch *checkFormat {
+	case "table":
+		err = writeCheckTable(os.Stdout, results)
+	case "junit":
+		err = writeJUnit(os.Stdout, results)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot write report: %v\n", err)
+		return 1
+	}
+	for _, r := range results {
+		if r.err != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkTLSFiles checks the web configuration file, and the TLS certificates and keys specified by flags, can be
+// loaded.
+func checkTLSFiles() []checkResult {
+	var results []checkResult
+	if *sslCrt != "" || *sslKey != "" {
+		start := time.Now()
+		_, err := tls.LoadX509KeyPair(*sslCrt, *sslKey)
+		results = append(results, checkResult{suite: "tls", name: "--web.certificate and --web.key", err: err, duration: time.Since(start)})
+	}
+	if *webConfigFile != "" {
+		start := time.Now()
+		c, err := loadWebConfig(*webConfigFile)
+		if err == nil && !*httpOnly {
+			_, err = c.tlsConfig("")
+		}
+		results = append(results, checkResult{suite: "tls", name: "--web.config.file", err: err, duration: time.Since(start)})
+	}
+	if *controlClientCA != "" {
+		start := time.Now()
+		_, err := loadCertPool(*controlClientCA)
+		results = append(results, checkResult{suite: "tls", name: "--control.client-ca", err: err, duration: time.Since(start)})
+	}
+	if *controlTokensFile != "" {
+		start := time.Now()
+		_, err := loadControlTokens(*controlTokensFile)
+		results = append(results, checkResult{suite: "tls", name: "--control.tokens-file", err: err, duration: time.Since(start)})
+	}
+	return results
+}
+
+// probeTargets probes the system endpoint of the named targets in cfg, at most concurrency at once.
+func probeTargets(cfg *config.Config, concurrency int) []checkResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var targets []*config.Target
+	for _, t := range cfg.Targets {
+		if t.Name != "" {
+			targets = append(targets, t)
+		}
+	}
+
+	results := make([]checkResult, len(targets))
+	sem := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, t *config.Target) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			start := time.Now()
+			user, pass, err := cfg.Credentials(t.Name)
+			firmware := ""
+			if err == nil {
+				firmware, err = collector.ProbeSystem(t.Name, user, pass)
+			}
+			r := checkResult{suite: "probe", name: t.Name, err: err, duration: time.Since(start)}
+			if err != nil {
+				r.detail = probeErrorKind(err)
+			} else {
+				r.detail = "firmware " + firmware
+			}
+			results[i] = r
+		}(i, t)
+	}
+	wg.Wait()
+	return results
+}
+
+// probeErrorKind classifies a probe error.
+func probeErrorKind(err error) string {
+	var statusErr *collector.StatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.Code == 401 || statusErr.Code == 403 {
+			return "auth error"
+		}
+		return "http error"
+	}
+	var (
+		recordErr tls.RecordHeaderError
+		alertErr  tls.AlertError
+		certErr   *tls.CertificateVerificationError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &certErr) || strings.Contains(err.Error(), "tls: ") {
+		return "tls error"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return "connection error"
+	}
+	return "error"
+}
+
+func writeCheckTable(w io.Writer, results []checkResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tNAME\tRESULT\tDETAIL")
+	failed := 0
+	for _, r := range results {
+		result, detail := "pass", r.detail
+		if r.err != nil {
+			result, failed = "FAIL", failed+1
+			detail = strings.TrimPrefix(strings.TrimSpace(r.detail+": "+r.err.Error()), ": ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.suite, r.name, result, detail)
+	}
+	fmt.Fprintf(tw, "\n%d checks, %d failed\n", len(results), failed)
+	return tw.Flush()
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	Failure   *junitFailure `xml:"failure"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func writeJUnit(w io.Writer, results []checkResult) error {
+	suites := junitTestSuites{Name: "servertech_exporter check"}
+	index := make(map[string]int)
+	for _, r := range results {
+		i, ok := index[r.suite]
+		if !ok {
+			i = len(suites.Suites)
+			index[r.suite] = i
+			suites.Suites = append(suites.Suites, junitTestSuite{Name: r.suite})
+		}
+		tc := junitTestCase{Name: r.name, Classname: r.suite, Time: fmt.Sprintf("%.3f", r.duration.Seconds())}
+		if r.err != nil {
+			tc.Failure = &junitFailure{Message: r.err.Error(), Type: r.detail, Text: r.err.Error()}
+			suites.Suites[i].Failures++
+			suites.Failures++
+		} else {
+			tc.SystemOut = r.detail
+		}
+		suites.Suites[i].Cases = append(suites.Suites[i].Cases, tc)
+		suites.Suites[i].Tests++
+		suites.Tests++
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
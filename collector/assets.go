@@ -0,0 +1,139 @@
+package collector
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	assetsFile = kingpin.Flag("collector.outlets.assets-file", "Path to a CSV or YAML file mapping PDU outlets to the assets plugged into them. The file is reloaded when it changes.").String()
+
+	outletAssets = &assetMapping{}
+)
+
+// asset is the asset plugged into an outlet of a PDU.
+type asset struct {
+	Target   string `yaml:"target"`
+	OutletID string `yaml:"outlet_id"`
+	Host     string `yaml:"host"`
+	AssetTag string `yaml:"asset_tag"`
+	Team     string `yaml:"team"`
+}
+
+type assetKey struct {
+	target, outletID string
+}
+
+type assetMapping struct {
+	mu      sync.Mutex
+	modTime time.Time
+	assets  map[assetKey]asset
+}
+
+// get returns the assets in path, reloading them if path was modified since they were last loaded. If reloading
+// fails, the previously loaded assets are returned.
+func (m *assetMapping) get(path string) map[assetKey]asset {
+	if path == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		slog.Error("cannot stat assets file", "err", err)
+		return m.assets
+	}
+	if m.assets != nil && info.ModTime().Equal(m.modTime) {
+		return m.assets
+	}
+
+	assets, err := loadAssets(path)
+	if err != nil {
+		slog.Error("cannot load assets file", "err", err)
+		return m.assets
+	}
+	slog.Info("loaded assets file", "path", path, "assets", len(assets))
+	m.assets, m.modTime = assets, info.ModTime()
+	return m.assets
+}
+
+func loadAssets(path string) (map[assetKey]asset, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []asset
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		if err := yaml.UnmarshalStrict(content, &list); err != nil {
+			return nil, fmt.Errorf("cannot parse %q: %v", path, err)
+		}
+	case ".csv":
+		list, err = parseAssetsCSV(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %q: %v", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown assets file extension %q, must be one of .csv, .yml or .yaml", filepath.Ext(path))
+	}
+
+	assets := make(map[assetKey]asset, len(list))
+	for i, a := range list {
+		if a.Target == "" || a.OutletID == "" {
+			return nil, fmt.Errorf("asset %d in %q does not have both a target and outlet_id", i+1, path)
+		}
+		assets[assetKey{a.Target, a.OutletID}] = a
+	}
+	return assets, nil
+}
+
+// parseAssetsCSV parses CSV with a header row naming the target, outlet_id, host, asset_tag and team columns.
+func parseAssetsCSV(content string) ([]asset, error) {
+	records, err := csv.NewReader(strings.NewReader(content)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"target", "outlet_id"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("header row does not contain a %q column", required)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	assets := make([]asset, 0, len(records)-1)
+	for _, record := range records[1:] {
+		assets = append(assets, asset{
+			Target:   field(record, "target"),
+			OutletID: field(record, "outlet_id"),
+			Host:     field(record, "host"),
+			AssetTag: field(record, "asset_tag"),
+			Team:     field(record, "team"),
+		})
+	}
+	return assets, nil
+}
@@ -1,78 +1,93 @@
 package collector
 
 import (
-	"encoding/json"
-	"fmt"
+	"strings"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/config"
 )
 
 var (
 	branchesSubsystem = "branches"
 
-	branchesLabels       = []string{"id", "name", "phase_id", "ocp_id"}
+	branchesLabels       = []string{"id", "name", "phase_id", "ocp_id", "unit_id", "cord_id", "position"}
 	branchesStatusLabels = append(branchesLabels, "status_type")
 
 	branchesDesc = map[string]*prometheus.Desc{
-		"amps":          colPromDesc(branchesSubsystem, "amps", "Floating point branch current in hundredth Amps. Available only if branch current sensing is present and value is known.", branchesLabels),
-		"amps_capacity": colPromDesc(branchesSubsystem, "amps_capacity", "Integer branch current capacity in whole Amps.", branchesLabels),
-		"state":         colPromDesc(branchesSubsystem, "state", "State (1 = On, 0 = Off)).", branchesLabels),
-		"status":        colPromDesc(branchesSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", branchesStatusLabels),
+		"info":                      colPromDesc(branchesSubsystem, "info", "Branch topology and identifying information, for joining with other branch metrics (always 1).", branchesLabels),
+		"amperes":                   colPromDesc(branchesSubsystem, "amperes", "Branch current in Amperes. Available only if branch current sensing is present and value is known.", branchesLabels),
+		"capacity_amperes":          colPromDesc(branchesSubsystem, "capacity_amperes", "Branch current capacity in Amperes.", branchesLabels),
+		"current_utilization_ratio": colPromDesc(branchesSubsystem, "current_utilization_ratio", "Branch current utilization as a ratio of the branch current capacity (0-1). Available only if branch current sensing is present and value is known.", branchesLabels),
+		"state":                     colPromDesc(branchesSubsystem, "state", "State (1 = On, 0 = Off)).", branchesLabels),
+		"status":                    colPromDesc(branchesSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", branchesStatusLabels),
 	}
 
-	totalBranchesErrors = 0.0
+	totalBranchesErrors atomic.Uint64
 )
 
 func init() {
-	registerCollector(branchesSubsystem, enabledByDefault, NewBranchesCollector)
+	registerCollector(branchesSubsystem, enabledByDefault, NewBranchesCollector, readBranches)
 }
 
 // BranchesCollector collects branches metrics, implemented as per the Collector interface.
 type BranchesCollector struct{}
 
 // NewBranchesCollector returns a new BranchesCollector.
-func NewBranchesCollector() Collector {
+func NewBranchesCollector(module *config.Module) Collector {
 	return &BranchesCollector{}
 }
 
 // Get metrics and send to the Prometheus.Metric channel.
-func (c *BranchesCollector) Get(ch chan<- prometheus.Metric, target, user, pass string) (float64, error) {
-
-	jsonBranches, err := getServerTechJSON(target, user, pass, "branches")
-	if err != nil {
-		totalBranchesErrors++
-		return totalBranchesErrors, fmt.Errorf("cannot get branchess: %s", err)
+func (c *BranchesCollector) Get(ch chan<- prometheus.Metric, r *Readings) (float64, error) {
+	if err := r.errs[branchesSubsystem]; err != nil {
+		return float64(totalBranchesErrors.Add(1)), err
 	}
+	processBranchesStats(ch, r.Branches)
+	return float64(totalBranchesErrors.Load()), nil
+}
 
-	if err := processBranchesStats(ch, jsonBranches); err != nil {
-		totalBranchesErrors++
-		return totalBranchesErrors, err
+// readBranches reads the branches of a PDU into r.
+func readBranches(r *Readings, get jawsGetter, module *config.Module) error {
+	var data branchesData
+	if err := get(branchesSubsystem, &data); err != nil {
+		return err
 	}
-	return totalBranchesErrors, nil
-
+	r.Branches = make([]BranchReadings, 0, len(data))
+	for _, d := range data {
+		r.Branches = append(r.Branches, BranchReadings{
+			Entity:                  newEntity(d.ID, d.Name),
+			PhaseID:                 d.PhaseID,
+			OcpID:                   d.OcpID,
+			CurrentAmperes:          d.Current,
+			CurrentCapacityAmperes:  d.CurrentCapacity,
+			CurrentUtilizationRatio: d.CurrentUtilized / 100,
+			State:                   strings.ToLower(d.State),
+			Statuses:                statuses("current", d.CurrentStatus, "branch", d.Status),
+		})
+	}
+	return nil
 }
 
-func processBranchesStats(ch chan<- prometheus.Metric, jsonBranchesSum []byte) error {
-	var jsonBranchess branchesData
+func processBranchesStats(ch chan<- prometheus.Metric, branches []BranchReadings) {
+	for _, data := range branches {
+		labels := append([]string{data.ID, data.Name, data.PhaseID, data.OcpID}, data.idLabels()...)
 
-	if err := json.Unmarshal(jsonBranchesSum, &jsonBranchess); err != nil {
-		return fmt.Errorf("cannot unmarshal branches json: %s", err)
-	}
-	for _, data := range jsonBranchess {
-		labels := []string{data.ID, data.Name, data.OcpID, data.PhaseID}
+		newGauge(ch, branchesDesc["info"], 1, labels...)
 
-		newGauge(ch, branchesDesc["amps"], data.Current, labels...)
-		newGauge(ch, branchesDesc["amps_capacity"], data.CurrentCapacity, labels...)
+		newGauge(ch, branchesDesc["amperes"], data.CurrentAmperes, labels...)
+		newGauge(ch, branchesDesc["capacity_amperes"], data.CurrentCapacityAmperes, labels...)
+		newGauge(ch, branchesDesc["current_utilization_ratio"], data.CurrentUtilizationRatio, labels...)
 
-		statusMetric(ch, branchesDesc["status"], data.CurrentStatus, "current", labels)
-		statusMetric(ch, branchesDesc["status"], data.Status, "branche", labels)
+		statusMetrics(ch, branchesDesc["status"], data.Statuses, labels)
 
 		stateMetric(ch, branchesDesc["state"], data.State, labels)
 	}
-	return nil
 }
 
-type branchesData []struct {
+type branchesData []branchData
+
+type branchData struct {
 	ID              string  `json:"id"`
 	Name            string  `json:"name"`
 	Current         float64 `json:"current"`
@@ -3,17 +3,22 @@ package collector
 import (
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
+	kingpin "github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
-	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	"github.com/tynany/servertech_exporter/config"
 )
 
 const (
@@ -25,7 +30,7 @@ const (
 )
 
 var (
-	servertechTotalScrapeCount = 0.0
+	servertechTotalScrapeCount atomic.Uint64
 
 	servertechLabels = []string{"collector"}
 	servertechDesc   = map[string]*prometheus.Desc{
@@ -35,25 +40,68 @@ var (
 		"collectorUp":    promDesc("collector_up", "Whether the collector's last scrape was successful (1 = successful, 0 = unsuccessful).", servertechLabels),
 	}
 
-	allCollectors  = make(map[string]func() Collector)
+	// metricUnits are the OpenMetrics units of metrics, set on descriptors of metrics with names ending in the unit.
+	metricUnits = []string{"volts", "amperes", "watts", "voltamps", "joules", "kilowatthours", "hertz", "seconds", "ratio"}
+
+	// startTime is the created timestamp of counters that are not specific to a target.
+	startTime = time.Now()
+
+	jawsLabels = []string{"path", "code"}
+
+	// ServerTech IDs encode the unit, cord and position of an entity, e.g. "BA12" is position 12 of cord "BA" on unit
+	// "B". Lines, phases, branches and OCPs are identified within their cord after a ':', e.g. "AA:L1", "AA:L1-L2",
+	// "AA:BR1" and "AA:CB1", with the first number after the ':' as their position.
+	idRegex = regexp.MustCompile(`^([A-Za-z])([A-Za-z])?(?:([0-9]+)|:[A-Za-z]*([0-9]+)?.*)?$`)
+
+	// metricInfos describes the metrics of all collectors by fully qualified name.
+	metricInfos = make(map[string]MetricInfo)
+
+	allCollectors  = make(map[string]func(module *config.Module) Collector)
+	readers        = make(map[string]reader)
 	collectorState = make(map[string]*bool)
-	httpTimeout    = kingpin.Flag("servertech.http.timeout", "The HTTP timeout when scraping the ServerTech API.").Default("20s").String()
+	httpTimeout    = kingpin.Flag("servertech.http.timeout", "The HTTP timeout when scraping the ServerTech API.").Default("20s").Duration()
 )
 
-func registerCollector(name string, enabledByDefault bool, collector func() Collector) {
+func init() {
+	// Target labels are added to every metric of the target, so must not clash with the labels of any metric.
+	config.ReserveLabels(jawsLabels...)
+	config.ReserveLabels("le")
+	for _, info := range metricInfos {
+		config.ReserveLabels(info.Labels...)
+	}
+}
+
+func registerCollector(name string, enabledByDefault bool, collector func(module *config.Module) Collector, read reader) {
 	defaultState := "disabled"
 	if enabledByDefault {
 		defaultState = "enabled"
 	}
 
 	allCollectors[name] = collector
+	readers[name] = read
 	collectorState[name] = kingpin.Flag(fmt.Sprintf("collector.%s", name), fmt.Sprintf("Enable the %s collector (default: %s).", name, defaultState)).Default(strconv.FormatBool(enabledByDefault)).Bool()
 }
 
+// Subsystems returns the names of all collectors, which are also the subsystems of their metrics, sorted.
+func Subsystems() []string {
+	names := make([]string, 0, len(allCollectors))
+	for name := range allCollectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Enabled returns whether the collector with name is enabled.
+func Enabled(name string) bool {
+	enabled, ok := collectorState[name]
+	return ok && *enabled
+}
+
 // Collector is the interface a collector has to implement.
 type Collector interface {
-	// Gets metrics and sends to the Prometheus.Metric channel.
-	Get(ch chan<- prometheus.Metric, target, user, pass string) (float64, error)
+	// Gets metrics from the readings of a PDU and sends to the Prometheus.Metric channel.
+	Get(ch chan<- prometheus.Metric, r *Readings) (float64, error)
 }
 
 // Exporter collects all collector metrics, implemented as per the prometheus.Collector interface.
@@ -62,14 +110,21 @@ type Exporter struct {
 	Target     string
 	User       string
 	Pass       string
+	// Logger logs the scrapes of the exporter, with the target and module added. slog.Default() is used if nil.
+	Logger *slog.Logger
+	// Readings of the target, read with the same module and collectors, that metrics are collected from. If nil,
+	// the target is read on every collect.
+	Readings *Readings
+
+	module *config.Module
 }
 
-// NewExporter returns a new Exporter.
-func NewExporter(target, user, pass string) *Exporter {
+// NewExporter returns a new Exporter. Module configures how the collectors scrape the target, and may be nil.
+func NewExporter(target, user, pass string, module *config.Module) *Exporter {
 	enabledCollectors := make(map[string]Collector)
 	for name, collector := range allCollectors {
 		if *collectorState[name] {
-			enabledCollectors[name] = collector()
+			enabledCollectors[name] = collector(module)
 		}
 	}
 	return &Exporter{
@@ -77,38 +132,73 @@ func NewExporter(target, user, pass string) *Exporter {
 		Target:     target,
 		User:       user,
 		Pass:       pass,
+		module:     module,
+	}
+}
+
+// logger returns the exporter's logger, with the target and module added.
+func (e *Exporter) logger() *slog.Logger {
+	return targetLogger(e.Logger, e.Target, e.module)
+}
+
+// targetLogger returns logger, or slog.Default() if nil, with the target and module, which may be nil, added.
+func targetLogger(logger *slog.Logger, target string, module *config.Module) *slog.Logger {
+	if logger == nil {
+		logger = slog.Default()
 	}
+	logger = logger.With("target", target)
+	if module != nil {
+		logger = logger.With("module", module.Name)
+	}
+	return logger
 }
 
 // Collect implemented as per the prometheus.Collector interface.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	servertechTotalScrapeCount++
-	ch <- prometheus.MustNewConstMetric(servertechDesc["scrapesTotal"], prometheus.CounterValue, servertechTotalScrapeCount)
-
-	wg := &sync.WaitGroup{}
+	newCounter(ch, servertechDesc["scrapesTotal"], float64(servertechTotalScrapeCount.Add(1)), startTime)
+
+	start := time.Now()
+	readings := e.Readings
+	if readings == nil {
+		subsystems := make([]string, 0, len(e.Collectors))
+		for name := range e.Collectors {
+			subsystems = append(subsystems, name)
+		}
+		readings = readSubsystems(e.logger(), e.Target, e.User, e.Pass, e.module, subsystems)
+	}
+	results := make([]CollectorResult, 0, len(e.Collectors))
 	for name, collector := range e.Collectors {
-		wg.Add(1)
-		go e.runCollector(ch, name, collector, wg)
+		results = append(results, e.runCollector(ch, name, collector, readings))
 	}
-	wg.Wait()
+	targetJAWSMetrics(e.Target).collect(ch)
+	recordScrape(e.Target, start, results)
+	e.logger().Debug("scrape finished", "duration", time.Since(start))
 }
 
-func (e *Exporter) runCollector(ch chan<- prometheus.Metric, name string, collector Collector, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	startTime := time.Now()
-	totalErrors, err := collector.Get(ch, e.Target, e.User, e.Pass)
+// runCollector runs a collector on the readings of the target, and returns its outcome. The duration of a collector
+// is the time taken to read its subsystem.
+func (e *Exporter) runCollector(ch chan<- prometheus.Metric, name string, collector Collector, readings *Readings) CollectorResult {
+	result := CollectorResult{Name: name, Duration: readings.durations[name]}
+	totalErrors, err := collector.Get(ch, readings)
 
-	ch <- prometheus.MustNewConstMetric(servertechDesc["scrapeDuration"], prometheus.GaugeValue, float64(time.Since(startTime).Seconds()), name)
+	ch <- prometheus.MustNewConstMetric(servertechDesc["scrapeDuration"], prometheus.GaugeValue, float64(result.Duration.Seconds()), name)
 	ch <- prometheus.MustNewConstMetric(servertechDesc["scrapeErrTotal"], prometheus.GaugeValue, totalErrors, name)
 
+	logger := e.logger().With("collector", name)
 	if err != nil {
 		ch <- prometheus.MustNewConstMetric(servertechDesc["collectorUp"], prometheus.GaugeValue, 0, name)
-		log.Errorf("collector %q scrape failed: %s", name, err)
+		var reqErr *RequestError
+		if errors.As(err, &reqErr) {
+			logger = logger.With("jaws_path", reqErr.Path)
+		}
+		logger.Error("collector scrape failed", "duration", result.Duration, "err", err)
+		result.Error = err.Error()
 	} else {
 		ch <- prometheus.MustNewConstMetric(servertechDesc["collectorUp"], prometheus.GaugeValue, 1, name)
+		logger.Debug("collector scrape succeeded", "duration", result.Duration)
+		result.Success = true
 	}
-
+	return result
 }
 
 // Describe implemented as per the prometheus.Collector interface.
@@ -119,53 +209,205 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func promDesc(metricName string, metricDescription string, labels []string) *prometheus.Desc {
-	return prometheus.NewDesc(namespace+"_"+metricName, metricDescription, labels, nil)
+	fqName := namespace + "_" + metricName
+	metricInfos[fqName] = MetricInfo{Name: metricName, FQName: fqName, Help: metricDescription, Unit: metricUnit(fqName), Labels: labels}
+	return newDesc(fqName, metricDescription, labels)
 }
 
 func colPromDesc(subsystem string, metricName string, metricDescription string, labels []string) *prometheus.Desc {
-	return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, metricName), metricDescription, labels, nil)
+	fqName := prometheus.BuildFQName(namespace, subsystem, metricName)
+	metricInfos[fqName] = MetricInfo{Subsystem: subsystem, Name: metricName, FQName: fqName, Help: metricDescription, Unit: metricUnit(fqName), Labels: labels}
+	return newDesc(fqName, metricDescription, labels)
+}
+
+// MetricInfo describes a metric of a collector, or of the exporter if Subsystem is empty.
+type MetricInfo struct {
+	Subsystem string
+	// Name of the metric within its subsystem.
+	Name   string
+	FQName string
+	Help   string
+	Unit   string
+	Labels []string
+}
+
+// LookupMetric returns the description of the metric of subsystem with name, or of the exporter if subsystem is
+// empty.
+func LookupMetric(subsystem, name string) (MetricInfo, bool) {
+	info, ok := metricInfos[prometheus.BuildFQName(namespace, subsystem, name)]
+	return info, ok
+}
+
+func newDesc(fqName string, metricDescription string, labels []string) *prometheus.Desc {
+	return prometheus.V2.NewDesc(fqName, metricDescription, prometheus.UnconstrainedLabels(labels), nil, prometheus.WithUnit(metricUnit(fqName)))
+}
+
+// metricUnit returns the unit of a metric, or an empty string if the name does not end in one of metricUnits.
+func metricUnit(fqName string) string {
+	name := strings.TrimSuffix(fqName, "_total")
+	for _, unit := range metricUnits {
+		if strings.HasSuffix(name, "_"+unit) {
+			return unit
+		}
+	}
+	return ""
 }
 
 func newGauge(ch chan<- prometheus.Metric, descName *prometheus.Desc, metric float64, labels ...string) {
 	ch <- prometheus.MustNewConstMetric(descName, prometheus.GaugeValue, metric, labels...)
 }
 
-func newCounter(ch chan<- prometheus.Metric, descName *prometheus.Desc, metric float64, labels ...string) {
-	ch <- prometheus.MustNewConstMetric(descName, prometheus.CounterValue, metric, labels...)
+func newCounter(ch chan<- prometheus.Metric, descName *prometheus.Desc, metric float64, created time.Time, labels ...string) {
+	ch <- prometheus.MustNewConstMetricWithCreatedTimestamp(descName, prometheus.CounterValue, metric, created, labels...)
+}
+
+// jawsRequestMetrics are histograms of the duration and response size of requests to the JAWS API of a target.
+type jawsRequestMetrics struct {
+	duration      *prometheus.HistogramVec
+	responseBytes *prometheus.HistogramVec
 }
 
-func getServerTechJSON(target, user, pass, path string) ([]byte, error) {
+func newJAWSRequestMetrics() *jawsRequestMetrics {
+	return &jawsRequestMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "jaws_request_duration_seconds",
+			Unit:      "seconds",
+			Help:      "Duration of requests to the ServerTech JAWS API, by path and HTTP status code (error if no response was received).",
+			Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 20},
+		}, jawsLabels),
+		responseBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "jaws_response_bytes",
+			Unit:      "bytes",
+			Help:      "Size of responses from the ServerTech JAWS API, by path and HTTP status code.",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+		}, jawsLabels),
+	}
+}
+
+func (m *jawsRequestMetrics) collect(ch chan<- prometheus.Metric) {
+	m.duration.Collect(ch)
+	m.responseBytes.Collect(ch)
+}
+
+// kilowattHoursToJoules converts an energy reading in kilowatt-hours to Joules.
+func kilowattHoursToJoules(kwh float64) float64 {
+	return kwh * 3.6e6
+}
+
+func doServerTechRequest(method, target, user, pass, path string, body io.Reader) (*http.Response, error) {
 	// todo: work out how to properly handle TLS verification, and avoid possible MITM attacks
 	transport := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
-	client := &http.Client{Transport: transport}
+	client := &http.Client{Transport: transport, Timeout: *httpTimeout}
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/jaws/monitor/%s", target, path), nil)
+	req, err := http.NewRequest(method, fmt.Sprintf("https://%s/jaws/%s", target, path), body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create http request: %v", err)
 	}
 	basicAuth := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
 	req.Header.Add("Authorization", "Basic "+basicAuth)
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to perform http request: %v", err)
+		return nil, fmt.Errorf("failed to perform http request: %w", err)
 	}
+	return resp, nil
+}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("incorrect status code received from device: %d", resp.StatusCode)
+// getServerTechJSON returns the body of the response to a request for path of the JAWS monitor API. Errors are
+// returned as a *RequestError. Requests are logged at debug level to logger, which should have the target added.
+func getServerTechJSON(logger *slog.Logger, target, user, pass, path string) ([]byte, error) {
+	metrics := targetJAWSMetrics(target)
+	start := time.Now()
+	resp, err := doServerTechRequest("GET", target, user, pass, "monitor/"+path, nil)
+	if err != nil {
+		duration := time.Since(start)
+		metrics.duration.WithLabelValues(path, "error").Observe(duration.Seconds())
+		logger.Debug("jaws request failed", "jaws_path", path, "duration", duration, "err", err)
+		return nil, &RequestError{Path: path, Duration: duration, Err: err}
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
+	duration := time.Since(start)
+	code := strconv.Itoa(resp.StatusCode)
+	metrics.duration.WithLabelValues(path, code).Observe(duration.Seconds())
+	metrics.responseBytes.WithLabelValues(path, code).Observe(float64(len(body)))
+	logger.Debug("jaws request", "jaws_path", path, "code", resp.StatusCode, "bytes", len(body), "duration", duration)
+
+	if resp.StatusCode != 200 {
+		return nil, &RequestError{Path: path, Duration: duration, Err: &StatusError{Code: resp.StatusCode}}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to read body of request from device: %v", err)
+		return nil, &RequestError{Path: path, Duration: duration, Err: fmt.Errorf("failed to read body of request from device: %v", err)}
 	}
 
 	return body, nil
 }
 
+// RequestError is an error requesting a path of the JAWS API.
+type RequestError struct {
+	Path     string
+	Duration time.Duration
+	Err      error
+}
+
+func (e *RequestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is returned when a device responds with an unexpected HTTP status code.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("incorrect status code received from device: %d", e.Code)
+}
+
+// idLabels returns the unit_id, cord_id and position label values parsed from a ServerTech ID. Parts of the
+// ID that are not present, or all parts if the ID is not in the expected format, are returned as empty strings.
+func idLabels(id string) []string {
+	m := idRegex.FindStringSubmatch(id)
+	if m == nil {
+		return []string{"", "", ""}
+	}
+	unitID, cordID := m[1], ""
+	if m[2] != "" {
+		cordID = m[1] + m[2]
+	}
+	return []string{unitID, cordID, m[3] + m[4]}
+}
+
+// PhaseLineID returns the ID of the input line a phase is measured from, the line its ID starts with, e.g. "AA:L1"
+// for the phases "AA:L1-L2" and "AA:L1-N". IDs without a ':' are returned as is, as the line and phase of PDUs that
+// do not qualify IDs share an ID.
+func PhaseLineID(phaseID string) string {
+	cordID, position, ok := strings.Cut(phaseID, ":")
+	if !ok {
+		return phaseID
+	}
+	line, _, _ := strings.Cut(position, "-")
+	return cordID + ":" + line
+}
+
+// statusMetrics sends a status metric for each status type of statuses.
+func statusMetrics(ch chan<- prometheus.Metric, desc *prometheus.Desc, statuses map[string]string, labels []string) {
+	for statusType, status := range statuses {
+		statusMetric(ch, desc, status, statusType, labels)
+	}
+}
+
 func statusMetric(ch chan<- prometheus.Metric, desc *prometheus.Desc, metric, statusType string, labels []string) {
 	status := float64(0)
 	if strings.ToLower(metric) == "normal" {
@@ -194,3 +436,22 @@ func reactanceMetric(ch chan<- prometheus.Metric, desc *prometheus.Desc, reactan
 	}
 	newGauge(ch, desc, reactance, labels...)
 }
+
+var controlStates = map[string]float64{
+	"idle off":   1,
+	"idle on":    2,
+	"wakeup off": 3,
+	"wakeup on":  4,
+	"off":        5,
+	"on":         6,
+	"locked off": 7,
+	"locked on":  8,
+	"reboot":     9,
+	"shutdown":   10,
+	"pend off":   11,
+	"pend on":    12,
+}
+
+func controlStateMetric(ch chan<- prometheus.Metric, desc *prometheus.Desc, controlStateStr string, labels []string) {
+	newGauge(ch, desc, controlStates[strings.ToLower(controlStateStr)], labels...)
+}
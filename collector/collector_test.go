@@ -0,0 +1,96 @@
+package collector
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestIDLabels(t *testing.T) {
+	for _, test := range []struct {
+		id       string
+		expected []string
+	}{
+		{"A", []string{"A", "", ""}},
+		{"AA", []string{"A", "AA", ""}},
+		{"AA1", []string{"A", "AA", "1"}},
+		{"BA12", []string{"B", "BA", "12"}},
+		{"AA:L1", []string{"A", "AA", "1"}},
+		{"AA:L1-L2", []string{"A", "AA", "1"}},
+		{"AA:L3-L1", []string{"A", "AA", "3"}},
+		{"BB:L2-N", []string{"B", "BB", "2"}},
+		{"AA:BR1", []string{"A", "AA", "1"}},
+		{"AB:BR12", []string{"A", "AB", "12"}},
+		{"AA:CB1", []string{"A", "AA", "1"}},
+		{"A:L1", []string{"A", "", "1"}},
+		{"AA:N", []string{"A", "AA", ""}},
+		{"", []string{"", "", ""}},
+		{"AAA1", []string{"", "", ""}},
+		{"1A", []string{"", "", ""}},
+		{"AA1:L1", []string{"", "", ""}},
+	} {
+		if labels := idLabels(test.id); !reflect.DeepEqual(labels, test.expected) {
+			t.Errorf("idLabels(%q): expected %q, got %q", test.id, test.expected, labels)
+		}
+	}
+}
+
+func TestPhaseLineID(t *testing.T) {
+	for _, test := range []struct {
+		id       string
+		expected string
+	}{
+		{"AA:L1-L2", "AA:L1"},
+		{"AA:L3-L1", "AA:L3"},
+		{"BB:L2-N", "BB:L2"},
+		{"AA:L1", "AA:L1"},
+		{"AA1", "AA1"},
+	} {
+		if id := PhaseLineID(test.id); id != test.expected {
+			t.Errorf("PhaseLineID(%q): expected %q, got %q", test.id, test.expected, id)
+		}
+	}
+}
+
+func TestCollectConcurrent(t *testing.T) {
+	readings := &Readings{
+		Target:    "pdu1",
+		errs:      map[string]error{branchesSubsystem: errors.New("timeout")},
+		durations: map[string]time.Duration{branchesSubsystem: time.Millisecond, linesSubsystem: time.Millisecond},
+		Lines:     []LineReadings{{Entity: entity("AA:L1"), CurrentAmperes: 4}},
+	}
+	e := &Exporter{
+		Collectors: map[string]Collector{branchesSubsystem: NewBranchesCollector(nil), linesSubsystem: NewLinesCollector(nil)},
+		Target:     "pdu1",
+		Readings:   readings,
+	}
+	scrapes, branchErrors := servertechTotalScrapeCount.Load(), totalBranchesErrors.Load()
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch := make(chan prometheus.Metric)
+			go func() {
+				e.Collect(ch)
+				close(ch)
+			}()
+			for range ch {
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := servertechTotalScrapeCount.Load() - scrapes; got != n {
+		t.Errorf("expected %d scrapes, got %d", n, got)
+	}
+	if got := totalBranchesErrors.Load() - branchErrors; got != n {
+		t.Errorf("expected %d branches errors, got %d", n, got)
+	}
+}
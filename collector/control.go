@@ -0,0 +1,59 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// OutletActions are the outlet control actions accepted by the JAWS control API.
+var OutletActions = []string{"on", "off", "reboot"}
+
+// outletIDRegex matches the IDs of outlets, e.g. AA1.
+var outletIDRegex = regexp.MustCompile(`^[A-Za-z]{1,2}[0-9]+$`)
+
+// ValidOutletID returns whether id is the ID of an outlet.
+func ValidOutletID(id string) bool {
+	return outletIDRegex.MatchString(id)
+}
+
+// ValidOutletAction returns whether action is one of OutletActions.
+func ValidOutletAction(action string) bool {
+	for _, a := range OutletActions {
+		if action == a {
+			return true
+		}
+	}
+	return false
+}
+
+// SetOutletControl performs a control action against an outlet using the JAWS control API.
+func SetOutletControl(target, user, pass, outletID, action string) error {
+	action = strings.ToLower(action)
+	if !ValidOutletAction(action) {
+		return fmt.Errorf("invalid outlet control action: %q", action)
+	}
+
+	body, err := json.Marshal(map[string]string{"control_action": action})
+	if err != nil {
+		return fmt.Errorf("failed to marshal control request: %v", err)
+	}
+
+	resp, err := doServerTechRequest("PATCH", target, user, pass, "control/outlets/"+url.PathEscape(outletID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("incorrect status code received from device: %d", resp.StatusCode)
+	}
+	// A redirect followed to another page, such as a login page, is not a response to the control request.
+	if resp.Request.Method != "PATCH" || resp.Request.URL.EscapedPath() != "/jaws/control/outlets/"+url.PathEscape(outletID) {
+		return fmt.Errorf("control request redirected to %s %s", resp.Request.Method, resp.Request.URL.EscapedPath())
+	}
+	return nil
+}
@@ -1,90 +1,118 @@
 package collector
 
 import (
-	"encoding/json"
-	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/config"
 )
 
 var (
 	cordsSubsystem = "cords"
 
-	cordsLabels       = []string{"id", "name", "plug_type"}
+	cordsLabels       = []string{"id", "name", "plug_type", "unit_id", "cord_id", "position"}
 	cordsStatusLabels = append(cordsLabels, "status_type")
 
 	cordsDesc = map[string]*prometheus.Desc{
-		"watts":                 colPromDesc(cordsSubsystem, "watts", "Integer cord power in Watts. Available only if cord power sensing is present and value is known (AC or DC).", cordsLabels),
-		"watts_capacity":        colPromDesc(cordsSubsystem, "watts_capacity", "Integer cord power capacity in Watts.", cordsLabels),
-		"voltamps":              colPromDesc(cordsSubsystem, "voltamps", "Integer cord apparent power ranging from 0 to maximum rated power in Volt-Amps. Available only if AC cord power sensing is present and value is known.", cordsLabels),
-		"kilowatthours":         colPromDesc(cordsSubsystem, "kilowatthours", "Floating point cord energy in tenth kilowatt-hours (kWh). Available only if energy sensing is present and value is known.", cordsLabels),
-		"hertz":                 colPromDesc(cordsSubsystem, "hertz", "Floating point cord frequency in tenth Hertz (Hz). Available only if frequency sensing is present and value is known.", cordsLabels),
-		"three_phase_imbalance": colPromDesc(cordsSubsystem, "three_phase_imbalance", "Floating point 3 phase out of balance percentage in tenths.. Available only if 3-phase AC cord current sensing is present and value is known.", cordsLabels),
-		"power_factor":          colPromDesc(cordsSubsystem, "power_factor", "Floating point cord power factor in hundredths. Available only if AC cord power factor sensing is present and value is known.", cordsLabels),
-		"state":                 colPromDesc(cordsSubsystem, "state", "State (1 = On, 0 = Off)).", cordsLabels),
-		"status":                colPromDesc(cordsSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", cordsStatusLabels),
+		"info":                    colPromDesc(cordsSubsystem, "info", "Cord topology and identifying information, for joining with other cord metrics (always 1).", cordsLabels),
+		"watts":                   colPromDesc(cordsSubsystem, "watts", "Integer cord power in Watts. Available only if cord power sensing is present and value is known (AC or DC).", cordsLabels),
+		"watts_capacity":          colPromDesc(cordsSubsystem, "watts_capacity", "Integer cord power capacity in Watts.", cordsLabels),
+		"power_utilization_ratio": colPromDesc(cordsSubsystem, "power_utilization_ratio", "Cord power utilization as a ratio of the cord power capacity (0-1). Available only if cord power sensing is present and value is known.", cordsLabels),
+		"voltamps":                colPromDesc(cordsSubsystem, "voltamps", "Integer cord apparent power ranging from 0 to maximum rated power in Volt-Amps. Available only if AC cord power sensing is present and value is known.", cordsLabels),
+		"kilowatthours":           colPromDesc(cordsSubsystem, "kilowatthours", "Floating point cord energy in tenth kilowatt-hours (kWh). Available only if energy sensing is present and value is known.", cordsLabels),
+		"energy_joules_total":     colPromDesc(cordsSubsystem, "energy_joules_total", "Cord energy in Joules. Available only if energy sensing is present and value is known.", cordsLabels),
+		"hertz":                   colPromDesc(cordsSubsystem, "hertz", "Floating point cord frequency in tenth Hertz (Hz). Available only if frequency sensing is present and value is known.", cordsLabels),
+		"three_phase_imbalance":   colPromDesc(cordsSubsystem, "three_phase_imbalance", "Floating point 3 phase out of balance percentage in tenths.. Available only if 3-phase AC cord current sensing is present and value is known.", cordsLabels),
+		"power_factor":            colPromDesc(cordsSubsystem, "power_factor", "Floating point cord power factor in hundredths. Available only if AC cord power factor sensing is present and value is known.", cordsLabels),
+		"state":                   colPromDesc(cordsSubsystem, "state", "State (1 = On, 0 = Off)).", cordsLabels),
+		"status":                  colPromDesc(cordsSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", cordsStatusLabels),
 	}
 
-	totalCordsErrors = 0.0
+	totalCordsErrors atomic.Uint64
 )
 
 func init() {
-	registerCollector(cordsSubsystem, enabledByDefault, NewCordsCollector)
+	registerCollector(cordsSubsystem, enabledByDefault, NewCordsCollector, readCords)
 }
 
 // CordsCollector collects cords metrics, implemented as per the Collector interface.
 type CordsCollector struct{}
 
 // NewCordsCollector returns a new CordsCollector.
-func NewCordsCollector() Collector {
+func NewCordsCollector(module *config.Module) Collector {
 	return &CordsCollector{}
 }
 
 // Get metrics and send to the Prometheus.Metric channel.
-func (c *CordsCollector) Get(ch chan<- prometheus.Metric, target, user, pass string) (float64, error) {
-
-	jsonCords, err := getServerTechJSON(target, user, pass, "cords")
-	if err != nil {
-		totalCordsErrors++
-		return totalCordsErrors, fmt.Errorf("cannot get cordss: %s", err)
+func (c *CordsCollector) Get(ch chan<- prometheus.Metric, r *Readings) (float64, error) {
+	if err := r.errs[cordsSubsystem]; err != nil {
+		return float64(totalCordsErrors.Add(1)), err
 	}
+	processCordsStats(ch, targetFirstSeen(r.Target), r.Cords)
+	return float64(totalCordsErrors.Load()), nil
+}
 
-	if err := processCordsStats(ch, jsonCords); err != nil {
-		totalCordsErrors++
-		return totalCordsErrors, err
+// readCords reads the cords of a PDU into r.
+func readCords(r *Readings, get jawsGetter, module *config.Module) error {
+	var data cordsData
+	if err := get(cordsSubsystem, &data); err != nil {
+		return err
 	}
-	return totalCordsErrors, nil
-
+	r.Cords = make([]CordReadings, 0, len(data))
+	for _, d := range data {
+		r.Cords = append(r.Cords, CordReadings{
+			Entity:                     newEntity(d.ID, d.Name),
+			PlugType:                   d.PlugType,
+			ActivePowerWatts:           d.ActivePower,
+			ApparentPowerVoltAmperes:   d.ApparentPower,
+			PowerCapacityWatts:         d.PowerCapacity,
+			PowerUtilizationRatio:      d.PowerUtilized / 100,
+			PowerFactor:                d.PowerFactor,
+			EnergyJoules:               kilowattHoursToJoules(d.Energy),
+			FrequencyHertz:             d.Frequency,
+			ThreePhaseImbalanceRatio:   d.ThreePhaseImbalance / 100,
+			State:                      strings.ToLower(d.State),
+			energyKilowattHours:        d.Energy,
+			threePhaseImbalancePercent: d.ThreePhaseImbalance,
+			Statuses: statuses(
+				"active power", d.ActivePowerStatus,
+				"apparent power", d.ApparentPowerStatus,
+				"power factor", d.PowerFactorStatus,
+				"three phase imbalance", d.ThreePhaseImbalanceStatus,
+				"cord", d.Status,
+			),
+		})
+	}
+	return nil
 }
 
-func processCordsStats(ch chan<- prometheus.Metric, jsonCordsSum []byte) error {
-	var jsonCords cordsData
-	if err := json.Unmarshal(jsonCordsSum, &jsonCords); err != nil {
-		return fmt.Errorf("cannot unmarshal cords json: %s", err)
-	}
-	for _, data := range jsonCords {
-		labels := []string{data.ID, data.Name, data.PlugType}
-
-		newGauge(ch, cordsDesc["watts"], data.ActivePower, labels...)
-		newGauge(ch, cordsDesc["watts_capacity"], data.PowerCapacity, labels...)
-		newGauge(ch, cordsDesc["voltamps"], data.ApparentPower, labels...)
-		newGauge(ch, cordsDesc["kilowatthours"], data.Energy, labels...)
-		newGauge(ch, cordsDesc["hertz"], data.Frequency, labels...)
-		newGauge(ch, cordsDesc["three_phase_imbalance"], data.ThreePhaseImbalance, labels...)
+func processCordsStats(ch chan<- prometheus.Metric, created time.Time, cords []CordReadings) {
+	for _, data := range cords {
+		labels := append([]string{data.ID, data.Name, data.PlugType}, data.idLabels()...)
+
+		newGauge(ch, cordsDesc["info"], 1, labels...)
+
+		newGauge(ch, cordsDesc["watts"], data.ActivePowerWatts, labels...)
+		newGauge(ch, cordsDesc["watts_capacity"], data.PowerCapacityWatts, labels...)
+		newGauge(ch, cordsDesc["power_utilization_ratio"], data.PowerUtilizationRatio, labels...)
+		newGauge(ch, cordsDesc["voltamps"], data.ApparentPowerVoltAmperes, labels...)
+		newGauge(ch, cordsDesc["kilowatthours"], data.energyKilowattHours, labels...)
+		newCounter(ch, cordsDesc["energy_joules_total"], data.EnergyJoules, created, labels...)
+		newGauge(ch, cordsDesc["hertz"], data.FrequencyHertz, labels...)
+		newGauge(ch, cordsDesc["three_phase_imbalance"], data.threePhaseImbalancePercent, labels...)
 		newGauge(ch, cordsDesc["power_factor"], data.PowerFactor, labels...)
 
-		statusMetric(ch, cordsDesc["status"], data.ActivePowerStatus, "active power", labels)
-		statusMetric(ch, cordsDesc["status"], data.ApparentPowerStatus, "apparent power", labels)
-		statusMetric(ch, cordsDesc["status"], data.PowerFactorStatus, "power factor", labels)
-		statusMetric(ch, cordsDesc["status"], data.ThreePhaseImbalanceStatus, "three phase imbalance", labels)
-		statusMetric(ch, cordsDesc["status"], data.Status, "cord", labels)
+		statusMetrics(ch, cordsDesc["status"], data.Statuses, labels)
 
 		stateMetric(ch, cordsDesc["state"], data.State, labels)
 	}
-	return nil
 }
 
-type cordsData []struct {
+type cordsData []cordData
+
+type cordData struct {
 	ID                        string  `json:"id"`
 	Name                      string  `json:"name"`
 	ActivePower               float64 `json:"active_power"`
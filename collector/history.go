@@ -0,0 +1,91 @@
+package collector
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+)
+
+var (
+	historySize = kingpin.Flag("servertech.scrape-history", "Number of recent scrape results kept in memory for the status page.").Default("1000").Int()
+
+	history = &scrapeHistory{}
+)
+
+// ScrapeResult is the outcome of a scrape of a target.
+type ScrapeResult struct {
+	Target   string        `json:"target"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration_ns"`
+	// Firmware of the PDU when it was last scraped by the system collector, if ever.
+	Firmware   string            `json:"firmware,omitempty"`
+	Collectors []CollectorResult `json:"collectors"`
+}
+
+// Success returns whether all collectors of the scrape succeeded.
+func (r ScrapeResult) Success() bool {
+	for _, c := range r.Collectors {
+		if !c.Success {
+			return false
+		}
+	}
+	return true
+}
+
+// CollectorResult is the outcome of a collector during a scrape.
+type CollectorResult struct {
+	Name     string        `json:"name"`
+	Success  bool          `json:"success"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// scrapeHistory is a ring buffer of recent scrape results.
+type scrapeHistory struct {
+	mu      sync.Mutex
+	results []ScrapeResult
+	// next is the index the next result is written to once the buffer is full.
+	next int
+}
+
+func (h *scrapeHistory) add(r ScrapeResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if *historySize <= 0 {
+		return
+	}
+	if len(h.results) < *historySize {
+		h.results = append(h.results, r)
+		return
+	}
+	h.results[h.next] = r
+	h.next = (h.next + 1) % len(h.results)
+}
+
+// RecentScrapes returns the recent scrape results of all targets, oldest first.
+func RecentScrapes() []ScrapeResult {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	results := make([]ScrapeResult, 0, len(history.results))
+	results = append(results, history.results[history.next:]...)
+	return append(results, history.results[:history.next]...)
+}
+
+// recordScrape adds the result of a scrape to the history, with the collectors sorted by name.
+func recordScrape(target string, start time.Time, collectors []CollectorResult) {
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].Name < collectors[j].Name })
+	state := targets.get(target)
+	targets.mu.Lock()
+	firmware := state.firmware
+	targets.mu.Unlock()
+	history.add(ScrapeResult{Target: target, Time: start, Duration: time.Since(start), Firmware: firmware, Collectors: collectors})
+}
+
+func recordFirmware(target, firmware string) {
+	state := targets.get(target)
+	targets.mu.Lock()
+	defer targets.mu.Unlock()
+	state.firmware = firmware
+}
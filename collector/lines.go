@@ -1,78 +1,91 @@
 package collector
 
 import (
-	"encoding/json"
-	"fmt"
+	"strings"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/config"
 )
 
 var (
 	linesSubsystem = "lines"
 
-	linesLabels       = []string{"id", "name"}
+	linesLabels       = []string{"id", "name", "unit_id", "cord_id", "position"}
 	linesStatusLabels = append(linesLabels, "status_type")
 
 	linesDesc = map[string]*prometheus.Desc{
-		"amps":          colPromDesc(linesSubsystem, "amps", "Floating point branch current in hundredth Amps. Available only if branch current sensing is present and value is known.", linesLabels),
-		"amps_capacity": colPromDesc(linesSubsystem, "amps_capacity", "Integer branch current capacity in whole Amps.", linesLabels),
-		"state":         colPromDesc(linesSubsystem, "state", "State (1 = On, 0 = Off)).", linesLabels),
-		"status":        colPromDesc(linesSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", linesStatusLabels),
+		"info":                      colPromDesc(linesSubsystem, "info", "Line topology and identifying information, for joining with other line metrics (always 1).", linesLabels),
+		"amperes":                   colPromDesc(linesSubsystem, "amperes", "Line current in Amperes. Available only if line current sensing is present and value is known.", linesLabels),
+		"capacity_amperes":          colPromDesc(linesSubsystem, "capacity_amperes", "Line current capacity in Amperes.", linesLabels),
+		"current_utilization_ratio": colPromDesc(linesSubsystem, "current_utilization_ratio", "Line current utilization as a ratio of the line current capacity (0-1). Available only if line current sensing is present and value is known.", linesLabels),
+		"state":                     colPromDesc(linesSubsystem, "state", "State (1 = On, 0 = Off)).", linesLabels),
+		"status":                    colPromDesc(linesSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", linesStatusLabels),
 	}
 
-	totalLinesErrors = 0.0
+	totalLinesErrors atomic.Uint64
 )
 
 func init() {
-	registerCollector(linesSubsystem, enabledByDefault, NewLinesCollector)
+	registerCollector(linesSubsystem, enabledByDefault, NewLinesCollector, readLines)
 }
 
 // LinesCollector collects lines metrics, implemented as per the Collector interface.
 type LinesCollector struct{}
 
 // NewLinesCollector returns a new LinesCollector.
-func NewLinesCollector() Collector {
+func NewLinesCollector(module *config.Module) Collector {
 	return &LinesCollector{}
 }
 
 // Get metrics and send to the Prometheus.Metric channel.
-func (c *LinesCollector) Get(ch chan<- prometheus.Metric, target, user, pass string) (float64, error) {
-
-	jsonLines, err := getServerTechJSON(target, user, pass, "lines")
-	if err != nil {
-		totalLinesErrors++
-		return totalLinesErrors, fmt.Errorf("cannot get liness: %s", err)
+func (c *LinesCollector) Get(ch chan<- prometheus.Metric, r *Readings) (float64, error) {
+	if err := r.errs[linesSubsystem]; err != nil {
+		return float64(totalLinesErrors.Add(1)), err
 	}
+	processLinesStats(ch, r.Lines)
+	return float64(totalLinesErrors.Load()), nil
+}
 
-	if err := processLinesStats(ch, jsonLines); err != nil {
-		totalLinesErrors++
-		return totalLinesErrors, err
+// readLines reads the input lines of a PDU into r.
+func readLines(r *Readings, get jawsGetter, module *config.Module) error {
+	var data linesData
+	if err := get(linesSubsystem, &data); err != nil {
+		return err
 	}
-	return totalLinesErrors, nil
-
+	r.Lines = make([]LineReadings, 0, len(data))
+	for _, d := range data {
+		r.Lines = append(r.Lines, LineReadings{
+			Entity:                  newEntity(d.ID, d.Name),
+			CurrentAmperes:          d.Current,
+			CurrentCapacityAmperes:  d.CurrentCapacity,
+			CurrentUtilizationRatio: d.CurrentUtilized / 100,
+			State:                   strings.ToLower(d.State),
+			Statuses:                statuses("current", d.CurrentStatus, "line", d.Status),
+		})
+	}
+	return nil
 }
 
-func processLinesStats(ch chan<- prometheus.Metric, jsonLinesSum []byte) error {
-	var jsonLiness linesData
+func processLinesStats(ch chan<- prometheus.Metric, lines []LineReadings) {
+	for _, data := range lines {
+		labels := append([]string{data.ID, data.Name}, data.idLabels()...)
 
-	if err := json.Unmarshal(jsonLinesSum, &jsonLiness); err != nil {
-		return fmt.Errorf("cannot unmarshal lines json: %s", err)
-	}
-	for _, data := range jsonLiness {
-		labels := []string{data.ID, data.Name}
+		newGauge(ch, linesDesc["info"], 1, labels...)
 
-		newGauge(ch, linesDesc["amps"], data.Current, labels...)
-		newGauge(ch, linesDesc["amps_capacity"], data.CurrentCapacity, labels...)
+		newGauge(ch, linesDesc["amperes"], data.CurrentAmperes, labels...)
+		newGauge(ch, linesDesc["capacity_amperes"], data.CurrentCapacityAmperes, labels...)
+		newGauge(ch, linesDesc["current_utilization_ratio"], data.CurrentUtilizationRatio, labels...)
 
-		statusMetric(ch, linesDesc["status"], data.CurrentStatus, "current", labels)
-		statusMetric(ch, linesDesc["status"], data.Status, "line", labels)
+		statusMetrics(ch, linesDesc["status"], data.Statuses, labels)
 
 		stateMetric(ch, linesDesc["state"], data.State, labels)
 	}
-	return nil
 }
 
-type linesData []struct {
+type linesData []lineData
+
+type lineData struct {
 	ID              string  `json:"id"`
 	Name            string  `json:"name"`
 	Current         float64 `json:"current"`
@@ -1,78 +1,94 @@
 package collector
 
 import (
-	"encoding/json"
-	"fmt"
+	"strings"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/config"
 )
 
 var (
 	ocpsSubsystem = "ocps"
 
-	ocpsLabels       = []string{"id", "name", "type"}
+	ocpsLabels       = []string{"id", "name", "type", "unit_id", "cord_id", "position"}
 	ocpsStatusLabels = append(ocpsLabels, "status_type")
 
 	ocpsDesc = map[string]*prometheus.Desc{
-		"amps":          colPromDesc(ocpsSubsystem, "amps", "Floating point branch current in hundredth Amps. Available only if branch current sensing is present and value is known.", ocpsLabels),
-		"amps_capacity": colPromDesc(ocpsSubsystem, "amps_capacity", "Integer branch current capacity in whole Amps.", ocpsLabels),
-		"state":         colPromDesc(ocpsSubsystem, "state", "State (1 = On, 0 = Off)).", ocpsLabels),
-		"status":        colPromDesc(ocpsSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", ocpsStatusLabels),
+		"info":             colPromDesc(ocpsSubsystem, "info", "OCP topology and identifying information, for joining with other OCP metrics (always 1).", ocpsLabels),
+		"amperes":          colPromDesc(ocpsSubsystem, "amperes", "OCP current in Amperes. Available only if OCP current sensing is present and value is known.", ocpsLabels),
+		"capacity_amperes": colPromDesc(ocpsSubsystem, "capacity_amperes", "OCP current capacity in Amperes.", ocpsLabels),
+		"state":            colPromDesc(ocpsSubsystem, "state", "State (1 = On, 0 = Off)).", ocpsLabels),
+		"status":           colPromDesc(ocpsSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", ocpsStatusLabels),
 	}
 
-	totalOcpsErrors = 0.0
+	totalOcpsErrors atomic.Uint64
 )
 
 func init() {
-	registerCollector(ocpsSubsystem, enabledByDefault, NewOcpsCollector)
+	registerCollector(ocpsSubsystem, enabledByDefault, NewOcpsCollector, readOcps)
 }
 
 // OcpsCollector collects ocps metrics, implemented as per the Collector interface.
 type OcpsCollector struct{}
 
 // NewOcpsCollector returns a new OcpsCollector.
-func NewOcpsCollector() Collector {
+func NewOcpsCollector(module *config.Module) Collector {
 	return &OcpsCollector{}
 }
 
 // Get metrics and send to the Prometheus.Metric channel.
-func (c *OcpsCollector) Get(ch chan<- prometheus.Metric, target, user, pass string) (float64, error) {
-
-	jsonOcps, err := getServerTechJSON(target, user, pass, "ocps")
-	if err != nil {
-		totalOcpsErrors++
-		return totalOcpsErrors, fmt.Errorf("cannot get ocpss: %s", err)
+func (c *OcpsCollector) Get(ch chan<- prometheus.Metric, r *Readings) (float64, error) {
+	if err := r.errs[ocpsSubsystem]; err != nil {
+		return float64(totalOcpsErrors.Add(1)), err
 	}
+	processOcpsStats(ch, r.Ocps)
+	return float64(totalOcpsErrors.Load()), nil
+}
 
-	if err := processOcpsStats(ch, jsonOcps); err != nil {
-		totalOcpsErrors++
-		return totalOcpsErrors, err
+// readOcps reads the over current protectors of a PDU into r.
+func readOcps(r *Readings, get jawsGetter, module *config.Module) error {
+	var data ocpsData
+	if err := get(ocpsSubsystem, &data); err != nil {
+		return err
 	}
-	return totalOcpsErrors, nil
-
+	r.Ocps = make([]OcpReadings, 0, len(data))
+	for _, d := range data {
+		r.Ocps = append(r.Ocps, OcpReadings{
+			Entity:                 newEntity(d.ID, d.Name),
+			Type:                   d.Type,
+			CurrentAmperes:         d.Current,
+			CurrentCapacityAmperes: d.CurrentCapacity,
+			State:                  strings.ToLower(d.State),
+			Statuses:               statuses("ocp", d.Status),
+		})
+	}
+	return nil
 }
 
-func processOcpsStats(ch chan<- prometheus.Metric, jsonOcpsSum []byte) error {
-	var jsonOcpss ocpsData
+func processOcpsStats(ch chan<- prometheus.Metric, ocps []OcpReadings) {
+	for _, data := range ocps {
+		labels := append([]string{data.ID, data.Name, data.Type}, data.idLabels()...)
 
-	if err := json.Unmarshal(jsonOcpsSum, &jsonOcpss); err != nil {
-		return fmt.Errorf("cannot unmarshal ocps json: %s", err)
-	}
-	for _, data := range jsonOcpss {
-		labels := []string{data.ID, data.Name, data.Type}
+		newGauge(ch, ocpsDesc["info"], 1, labels...)
 
-		newGauge(ch, ocpsDesc["amps_capacity"], data.CurrentCapacity, labels...)
+		newGauge(ch, ocpsDesc["amperes"], data.CurrentAmperes, labels...)
+		newGauge(ch, ocpsDesc["capacity_amperes"], data.CurrentCapacityAmperes, labels...)
 
-		statusMetric(ch, ocpsDesc["status"], data.Status, "ocp", labels)
+		statusMetrics(ch, ocpsDesc["status"], data.Statuses, labels)
 
+		stateMetric(ch, ocpsDesc["state"], data.State, labels)
 	}
-	return nil
 }
 
-type ocpsData []struct {
+type ocpsData []ocpData
+
+type ocpData struct {
 	ID              string  `json:"id"`
 	Name            string  `json:"name"`
+	Current         float64 `json:"current"`
 	CurrentCapacity float64 `json:"current_capacity"`
+	State           string  `json:"state"`
 	Status          string  `json:"status"`
 	Type            string  `json:"type"`
 }
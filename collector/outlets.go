@@ -1,105 +1,153 @@
 package collector
 
 import (
-	"encoding/json"
-	"fmt"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/config"
 )
 
 var (
 	outletsSubsystem = "outlets"
 
-	outletsLabels       = []string{"id", "name", "branch_id", "ocp_id", "phase_id", "socket_adapter", "socket_type"}
+	outletsLabels       = []string{"id", "name", "branch_id", "ocp_id", "phase_id", "socket_adapter", "socket_type", "unit_id", "cord_id", "position", "host", "asset_tag", "team"}
 	outletsStatusLabels = append(outletsLabels, "status_type")
 
 	outletsDesc = map[string]*prometheus.Desc{
-		"watts":          colPromDesc(outletsSubsystem, "watts", "Integer outlet power in Watts. Available only if outlet power sensing is present and value is known (AC or DC).", outletsLabels),
-		"watts_capacity": colPromDesc(outletsSubsystem, "watts_capacity", "Integer power capacity in VA for AC products and Watts for DC products.", outletsLabels),
-		"voltamps":       colPromDesc(outletsSubsystem, "voltamps", "Integer outlet apparent power in Volt-Amps. Available only if outlet apparent power sensing is present and value is known.", outletsLabels),
-		"amps":           colPromDesc(outletsSubsystem, "amps", "Floating point outlet current in hundredth Amps. Available only if outlet current sensing is present and value is known.", outletsLabels),
-		"amps_capacity":  colPromDesc(outletsSubsystem, "amps_capacity", "Integer outlet current capacity in whole Amps.", outletsLabels),
-		"crest_factor":   colPromDesc(outletsSubsystem, "crest_factor", "Floating point outlet crest factor in tenths. Available only if outlet crest factor sensing is present and value is known.", outletsLabels),
-		"kilowatthours":  colPromDesc(outletsSubsystem, "kilowatthours", "Floating point outlet energy in tenth kilowatt-hours (kWh). Available only if energy sensing is present and value is known.", outletsLabels),
-		"power_factor":   colPromDesc(outletsSubsystem, "power_factor", "Floating point outlet power factor in hundredths. Available only if AC cord power factor sensing is present and value is known.", outletsLabels),
-		"reactance":      colPromDesc(outletsSubsystem, "reactance", "Status of the measured outlet reactance. Available only if outletpower factor sensing present and value is known (0 = Unknown, 1 = Capacitive, 2 = Inductive, 3 = Resistive.", outletsLabels),
-		"volts":          colPromDesc(outletsSubsystem, "volts", "Floating point outlet voltage in tenth Volts. Available only if voltage sensing is present and value is known.", outletsLabels),
-		"state":          colPromDesc(outletsSubsystem, "state", "State (1 = On, 0 = Off)).", outletsLabels),
-		"status":         colPromDesc(outletsSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", outletsStatusLabels),
+		"info":                      colPromDesc(outletsSubsystem, "info", "Outlet topology and identifying information, for joining with other outlet metrics (always 1).", outletsLabels),
+		"watts":                     colPromDesc(outletsSubsystem, "watts", "Integer outlet power in Watts. Available only if outlet power sensing is present and value is known (AC or DC).", outletsLabels),
+		"watts_capacity":            colPromDesc(outletsSubsystem, "watts_capacity", "Integer power capacity in VA for AC products and Watts for DC products.", outletsLabels),
+		"voltamps":                  colPromDesc(outletsSubsystem, "voltamps", "Integer outlet apparent power in Volt-Amps. Available only if outlet apparent power sensing is present and value is known.", outletsLabels),
+		"amperes":                   colPromDesc(outletsSubsystem, "amperes", "Outlet current in Amperes. Available only if outlet current sensing is present and value is known.", outletsLabels),
+		"capacity_amperes":          colPromDesc(outletsSubsystem, "capacity_amperes", "Outlet current capacity in Amperes.", outletsLabels),
+		"crest_factor":              colPromDesc(outletsSubsystem, "crest_factor", "Floating point outlet crest factor in tenths. Available only if outlet crest factor sensing is present and value is known.", outletsLabels),
+		"kilowatthours":             colPromDesc(outletsSubsystem, "kilowatthours", "Floating point outlet energy in tenth kilowatt-hours (kWh). Available only if energy sensing is present and value is known.", outletsLabels),
+		"energy_joules_total":       colPromDesc(outletsSubsystem, "energy_joules_total", "Outlet energy in Joules. Available only if energy sensing is present and value is known.", outletsLabels),
+		"current_utilization_ratio": colPromDesc(outletsSubsystem, "current_utilization_ratio", "Outlet current utilization as a ratio of the outlet current capacity (0-1). Available only if outlet current sensing is present and value is known.", outletsLabels),
+		"power_factor":              colPromDesc(outletsSubsystem, "power_factor", "Floating point outlet power factor in hundredths. Available only if AC cord power factor sensing is present and value is known.", outletsLabels),
+		"reactance":                 colPromDesc(outletsSubsystem, "reactance", "Status of the measured outlet reactance. Available only if outletpower factor sensing present and value is known (0 = Unknown, 1 = Capacitive, 2 = Inductive, 3 = Resistive.", outletsLabels),
+		"volts":                     colPromDesc(outletsSubsystem, "volts", "Floating point outlet voltage in tenth Volts. Available only if voltage sensing is present and value is known.", outletsLabels),
+		"state":                     colPromDesc(outletsSubsystem, "state", "State (1 = On, 0 = Off)).", outletsLabels),
+		"control_state":             colPromDesc(outletsSubsystem, "control_state", "Control state (0 = Unknown, 1 = Idle Off, 2 = Idle On, 3 = Wakeup Off, 4 = Wakeup On, 5 = Off, 6 = On, 7 = Locked Off, 8 = Locked On, 9 = Reboot, 10 = Shutdown, 11 = Pend Off, 12 = Pend On).", outletsLabels),
+		"suppressed_series":         colPromDesc(outletsSubsystem, "suppressed_series", "Number of outlet series not exported in the last scrape because the outlet was filtered out by the module.", nil),
+		"status":                    colPromDesc(outletsSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", outletsStatusLabels),
 	}
 
-	totalOutletsErrors = 0.0
+	totalOutletsErrors atomic.Uint64
 )
 
 func init() {
-	registerCollector(outletsSubsystem, enabledByDefault, NewOutletsCollector)
+	registerCollector(outletsSubsystem, enabledByDefault, NewOutletsCollector, readOutlets)
 }
 
 // OutletsCollector collects outlets metrics, implemented as per the Collector interface.
 type OutletsCollector struct{}
 
 // NewOutletsCollector returns a new OutletsCollector.
-func NewOutletsCollector() Collector {
+func NewOutletsCollector(module *config.Module) Collector {
 	return &OutletsCollector{}
 }
 
 // Get metrics and send to the Prometheus.Metric channel.
-func (c *OutletsCollector) Get(ch chan<- prometheus.Metric, target, user, pass string) (float64, error) {
-
-	jsonOutlets, err := getServerTechJSON(target, user, pass, "outlets")
-	if err != nil {
-		totalOutletsErrors++
-		return totalOutletsErrors, fmt.Errorf("cannot get outletss: %s", err)
+func (c *OutletsCollector) Get(ch chan<- prometheus.Metric, r *Readings) (float64, error) {
+	if err := r.errs[outletsSubsystem]; err != nil {
+		return float64(totalOutletsErrors.Add(1)), err
 	}
+	processOutletsStats(ch, targetFirstSeen(r.Target), r.Outlets, r.suppressedOutletSeries)
+	return float64(totalOutletsErrors.Load()), nil
+}
 
-	if err := processOutletsStats(ch, jsonOutlets); err != nil {
-		totalOutletsErrors++
-		return totalOutletsErrors, err
+// readOutlets reads the outlets of a PDU into r, with the assets mapped to them. Outlets are filtered by module,
+// which may be nil.
+func readOutlets(r *Readings, get jawsGetter, module *config.Module) error {
+	var data outletsData
+	if err := get(outletsSubsystem, &data); err != nil {
+		return err
 	}
-	return totalOutletsErrors, nil
-
+	var filter *config.OutletsFilter
+	if module != nil {
+		filter = &module.Outlets
+	}
+	assets := outletAssets.get(*assetsFile)
+	r.Outlets = make([]OutletReadings, 0, len(data))
+	for _, d := range data {
+		asset := assets[assetKey{r.Target, d.ID}]
+		outlet := OutletReadings{
+			Entity:                   newEntity(d.ID, d.Name),
+			BranchID:                 d.BranchID,
+			OcpID:                    d.OcpID,
+			PhaseID:                  d.PhaseID,
+			SocketType:               d.SocketType,
+			SocketAdapter:            d.SocketAdapter,
+			Host:                     asset.Host,
+			AssetTag:                 asset.AssetTag,
+			Team:                     asset.Team,
+			ActivePowerWatts:         d.ActivePower,
+			ApparentPowerVoltAmperes: d.ApparentPower,
+			PowerCapacityWatts:       d.PowerCapacity,
+			CurrentAmperes:           d.Current,
+			CurrentCapacityAmperes:   d.CurrentCapacity,
+			CurrentUtilizationRatio:  d.CurrentUtilized / 100,
+			VoltageVolts:             d.Voltage,
+			PowerFactor:              d.PowerFactor,
+			CrestFactor:              d.CrestFactor,
+			Reactance:                strings.ToLower(d.Reactance),
+			EnergyJoules:             kilowattHoursToJoules(d.Energy),
+			State:                    strings.ToLower(d.State),
+			ControlState:             strings.ToLower(d.ControlState),
+			Statuses: statuses(
+				"active power", d.ActivePowerStatus,
+				"current", d.CurrentStatus,
+				"power factor", d.PowerFactorStatus,
+				"outlet", d.Status,
+			),
+			energyKilowattHours: d.Energy,
+		}
+		if !filter.Keep(d.ID, d.Name, d.State, d.Energy) {
+			// Counted by the number of series the outlet would have been exported with: one per descriptor,
+			// except suppressed_series, with a status series per status type.
+			r.suppressedOutletSeries += len(outletsDesc) - 2 + len(outlet.Statuses)
+			continue
+		}
+		r.Outlets = append(r.Outlets, outlet)
+	}
+	return nil
 }
 
-func processOutletsStats(ch chan<- prometheus.Metric, jsonOutletsSum []byte) error {
-	var jsonOutlets outletsData
-	if err := json.Unmarshal(jsonOutletsSum, &jsonOutlets); err != nil {
-		return fmt.Errorf("cannot unmarshal outlets json: %s", err)
-	}
-	for _, data := range jsonOutlets {
-		labels := []string{data.ID, data.Name, data.BranchID, data.OcpID, data.PhaseID, data.SocketAdapter, data.SocketType}
-
-		newGauge(ch, outletsDesc["watts"], data.ActivePower, labels...)
-		newGauge(ch, outletsDesc["watts_capacity"], data.PowerCapacity, labels...)
-		newGauge(ch, outletsDesc["voltamps"], data.ApparentPower, labels...)
-		newGauge(ch, outletsDesc["amps"], data.Current, labels...)
-		newGauge(ch, outletsDesc["amps_capacity"], data.CurrentCapacity, labels...)
+func processOutletsStats(ch chan<- prometheus.Metric, created time.Time, outlets []OutletReadings, suppressedSeries int) {
+	for _, data := range outlets {
+		labels := append([]string{data.ID, data.Name, data.BranchID, data.OcpID, data.PhaseID, data.SocketAdapter, data.SocketType}, data.idLabels()...)
+		labels = append(labels, data.Host, data.AssetTag, data.Team)
+
+		newGauge(ch, outletsDesc["info"], 1, labels...)
+
+		newGauge(ch, outletsDesc["watts"], data.ActivePowerWatts, labels...)
+		newGauge(ch, outletsDesc["watts_capacity"], data.PowerCapacityWatts, labels...)
+		newGauge(ch, outletsDesc["voltamps"], data.ApparentPowerVoltAmperes, labels...)
+		newGauge(ch, outletsDesc["amperes"], data.CurrentAmperes, labels...)
+		newGauge(ch, outletsDesc["capacity_amperes"], data.CurrentCapacityAmperes, labels...)
+		newGauge(ch, outletsDesc["current_utilization_ratio"], data.CurrentUtilizationRatio, labels...)
 		newGauge(ch, outletsDesc["crest_factor"], data.CrestFactor, labels...)
-		newGauge(ch, outletsDesc["kilowatthours"], data.Energy, labels...)
+		newGauge(ch, outletsDesc["kilowatthours"], data.energyKilowattHours, labels...)
+		newCounter(ch, outletsDesc["energy_joules_total"], data.EnergyJoules, created, labels...)
 		newGauge(ch, outletsDesc["power_factor"], data.PowerFactor, labels...)
-		newGauge(ch, outletsDesc["volts"], data.Voltage, labels...)
-
-		reactance := float64(0)
-		if strings.ToLower(data.Reactance) == "capacitive" {
-			reactance = 1
-		} else if strings.ToLower(data.Reactance) == "inductive" {
-			reactance = 2
-		} else if strings.ToLower(data.Reactance) == "resistive" {
-			reactance = 3
-		}
-		newGauge(ch, outletsDesc["reactance"], reactance, labels...)
+		newGauge(ch, outletsDesc["volts"], data.VoltageVolts, labels...)
 
-		statusMetric(ch, outletsDesc["status"], data.ActivePowerStatus, "active power", labels)
-		statusMetric(ch, outletsDesc["status"], data.CurrentStatus, "current", labels)
-		statusMetric(ch, outletsDesc["status"], data.PowerFactorStatus, "power factor", labels)
-		statusMetric(ch, outletsDesc["status"], data.Status, "outlet", labels)
+		reactanceMetric(ch, outletsDesc["reactance"], data.Reactance, labels)
+
+		statusMetrics(ch, outletsDesc["status"], data.Statuses, labels)
 
 		stateMetric(ch, outletsDesc["state"], data.State, labels)
+		controlStateMetric(ch, outletsDesc["control_state"], data.ControlState, labels)
 	}
-	return nil
+	newGauge(ch, outletsDesc["suppressed_series"], float64(suppressedSeries))
 }
 
-type outletsData []struct {
+type outletsData []outletData
+
+type outletData struct {
 	ID                string  `json:"id"`
 	Name              string  `json:"name"`
 	ActivePower       float64 `json:"active_power"`
@@ -1,95 +1,118 @@
 package collector
 
 import (
-	"encoding/json"
-	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/config"
 )
 
 var (
 	phasesSubsystem = "phases"
 
-	phasesLabels       = []string{"id", "name"}
+	phasesLabels       = []string{"id", "name", "unit_id", "cord_id", "position"}
 	phasesStatusLabels = append(phasesLabels, "status_type")
 
 	phasesDesc = map[string]*prometheus.Desc{
-		"watts":           colPromDesc(phasesSubsystem, "watts", "Integer phase power in Watts. Available only if phase power sensing is present and value is known (AC or DC).", phasesLabels),
-		"voltamps":        colPromDesc(phasesSubsystem, "voltamps", "Integer phase apparent power in Volt-Amps. Available only if phase apparent power sensing is present and value is known.", phasesLabels),
-		"amps":            colPromDesc(phasesSubsystem, "amps", "Floating point phase current in hundredth Amps. Available only if phase current sensing is present and value is known.", phasesLabels),
-		"crest_factor":    colPromDesc(phasesSubsystem, "crest_factor", "Floating point phase crest factor in tenths. Available only if phase crest factor sensing is present and value is known.", phasesLabels),
-		"kilowatthours":   colPromDesc(phasesSubsystem, "kilowatthours", "Floating point phase energy in tenth kilowatt-hours (kWh). Available only if energy sensing is present and value is known.", phasesLabels),
-		"nominal_volts":   colPromDesc(phasesSubsystem, "nominal_volts", "Integer phase nominal voltage in Volts. Available only if phase voltage sensing present.", phasesLabels),
-		"power_factor":    colPromDesc(phasesSubsystem, "power_factor", "Floating point phase power factor in hundredths. Available only if AC cord power factor sensing is present and value is known.", phasesLabels),
-		"reactance":       colPromDesc(phasesSubsystem, "reactance", "Status of the measured phase reactance. Available only if phasepower factor sensing present and value is known (0 = Unknown, 1 = Capacitive, 2 = Inductive, 3 = Resistive.", phasesLabels),
-		"volts":           colPromDesc(phasesSubsystem, "volts", "Floating point phase voltage in tenth Volts. Available only if voltage sensing is present and value is known. ", phasesLabels),
-		"volts_deviation": colPromDesc(phasesSubsystem, "volts_deviation", "Floating point phase deviation percentage from nominal voltage in tenths. Available only if phase voltage sensing present.", phasesLabels),
-		"state":           colPromDesc(phasesSubsystem, "state", "State (1 = On, 0 = Off)).", phasesLabels),
-		"status":          colPromDesc(phasesSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", phasesStatusLabels),
+		"info":                colPromDesc(phasesSubsystem, "info", "Phase topology and identifying information, for joining with other phase metrics (always 1).", phasesLabels),
+		"watts":               colPromDesc(phasesSubsystem, "watts", "Integer phase power in Watts. Available only if phase power sensing is present and value is known (AC or DC).", phasesLabels),
+		"voltamps":            colPromDesc(phasesSubsystem, "voltamps", "Integer phase apparent power in Volt-Amps. Available only if phase apparent power sensing is present and value is known.", phasesLabels),
+		"amperes":             colPromDesc(phasesSubsystem, "amperes", "Phase current in Amperes. Available only if phase current sensing is present and value is known.", phasesLabels),
+		"crest_factor":        colPromDesc(phasesSubsystem, "crest_factor", "Floating point phase crest factor in tenths. Available only if phase crest factor sensing is present and value is known.", phasesLabels),
+		"kilowatthours":       colPromDesc(phasesSubsystem, "kilowatthours", "Floating point phase energy in tenth kilowatt-hours (kWh). Available only if energy sensing is present and value is known.", phasesLabels),
+		"energy_joules_total": colPromDesc(phasesSubsystem, "energy_joules_total", "Phase energy in Joules. Available only if energy sensing is present and value is known.", phasesLabels),
+		"nominal_volts":       colPromDesc(phasesSubsystem, "nominal_volts", "Integer phase nominal voltage in Volts. Available only if phase voltage sensing present.", phasesLabels),
+		"power_factor":        colPromDesc(phasesSubsystem, "power_factor", "Floating point phase power factor in hundredths. Available only if AC cord power factor sensing is present and value is known.", phasesLabels),
+		"reactance":           colPromDesc(phasesSubsystem, "reactance", "Status of the measured phase reactance. Available only if phasepower factor sensing present and value is known (0 = Unknown, 1 = Capacitive, 2 = Inductive, 3 = Resistive.", phasesLabels),
+		"volts":               colPromDesc(phasesSubsystem, "volts", "Floating point phase voltage in tenth Volts. Available only if voltage sensing is present and value is known. ", phasesLabels),
+		"volts_deviation":     colPromDesc(phasesSubsystem, "volts_deviation", "Floating point phase deviation percentage from nominal voltage in tenths. Available only if phase voltage sensing present.", phasesLabels),
+		"state":               colPromDesc(phasesSubsystem, "state", "State (1 = On, 0 = Off)).", phasesLabels),
+		"status":              colPromDesc(phasesSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", phasesStatusLabels),
 	}
 
-	totalPhasesErrors = 0.0
+	totalPhasesErrors atomic.Uint64
 )
 
 func init() {
-	registerCollector(phasesSubsystem, enabledByDefault, NewPhasesCollector)
+	registerCollector(phasesSubsystem, enabledByDefault, NewPhasesCollector, readPhases)
 }
 
 // PhasesCollector collects phases metrics, implemented as per the Collector interface.
 type PhasesCollector struct{}
 
 // NewPhasesCollector returns a new PhasesCollector.
-func NewPhasesCollector() Collector {
+func NewPhasesCollector(module *config.Module) Collector {
 	return &PhasesCollector{}
 }
 
 // Get metrics and send to the Prometheus.Metric channel.
-func (c *PhasesCollector) Get(ch chan<- prometheus.Metric, target, user, pass string) (float64, error) {
-
-	jsonPhases, err := getServerTechJSON(target, user, pass, "phases")
-	if err != nil {
-		totalPhasesErrors++
-		return totalPhasesErrors, fmt.Errorf("cannot get phasess: %s", err)
+func (c *PhasesCollector) Get(ch chan<- prometheus.Metric, r *Readings) (float64, error) {
+	if err := r.errs[phasesSubsystem]; err != nil {
+		return float64(totalPhasesErrors.Add(1)), err
 	}
+	processPhasesStats(ch, targetFirstSeen(r.Target), r.Phases)
+	return float64(totalPhasesErrors.Load()), nil
+}
 
-	if err := processPhasesStats(ch, jsonPhases); err != nil {
-		totalPhasesErrors++
-		return totalPhasesErrors, err
+// readPhases reads the phases of a PDU into r.
+func readPhases(r *Readings, get jawsGetter, module *config.Module) error {
+	var data phasesData
+	if err := get(phasesSubsystem, &data); err != nil {
+		return err
 	}
-	return totalPhasesErrors, nil
-
+	r.Phases = make([]PhaseReadings, 0, len(data))
+	for _, d := range data {
+		r.Phases = append(r.Phases, PhaseReadings{
+			Entity:                   newEntity(d.ID, d.Name),
+			ActivePowerWatts:         d.ActivePower,
+			ApparentPowerVoltAmperes: d.ApparentPower,
+			CurrentAmperes:           d.Current,
+			VoltageVolts:             d.Voltage,
+			NominalVoltageVolts:      d.NominalVoltage,
+			VoltageDeviationRatio:    d.VoltageDeviation / 100,
+			PowerFactor:              d.PowerFactor,
+			CrestFactor:              d.CrestFactor,
+			Reactance:                strings.ToLower(d.Reactance),
+			EnergyJoules:             kilowattHoursToJoules(d.Energy),
+			State:                    strings.ToLower(d.State),
+			Statuses:                 statuses("power factor", d.PowerFactorStatus, "voltage", d.VoltageStatus, "phase", d.Status),
+			energyKilowattHours:      d.Energy,
+			voltageDeviationPercent:  d.VoltageDeviation,
+		})
+	}
+	return nil
 }
 
-func processPhasesStats(ch chan<- prometheus.Metric, jsonPhasesSum []byte) error {
-	var jsonPhases phasesData
-	if err := json.Unmarshal(jsonPhasesSum, &jsonPhases); err != nil {
-		return fmt.Errorf("cannot unmarshal phases json: %s", err)
-	}
-	for _, data := range jsonPhases {
-		labels := []string{data.ID, data.Name}
+func processPhasesStats(ch chan<- prometheus.Metric, created time.Time, phases []PhaseReadings) {
+	for _, data := range phases {
+		labels := append([]string{data.ID, data.Name}, data.idLabels()...)
+
+		newGauge(ch, phasesDesc["info"], 1, labels...)
 
-		newGauge(ch, phasesDesc["watts"], data.ActivePower, labels...)
-		newGauge(ch, phasesDesc["voltamps"], data.ApparentPower, labels...)
-		newGauge(ch, phasesDesc["amps"], data.Current, labels...)
+		newGauge(ch, phasesDesc["watts"], data.ActivePowerWatts, labels...)
+		newGauge(ch, phasesDesc["voltamps"], data.ApparentPowerVoltAmperes, labels...)
+		newGauge(ch, phasesDesc["amperes"], data.CurrentAmperes, labels...)
 		newGauge(ch, phasesDesc["crest_factor"], data.CrestFactor, labels...)
-		newGauge(ch, phasesDesc["kilowatthours"], data.Energy, labels...)
-		newGauge(ch, phasesDesc["nominal_volts"], data.NominalVoltage, labels...)
+		newGauge(ch, phasesDesc["kilowatthours"], data.energyKilowattHours, labels...)
+		newCounter(ch, phasesDesc["energy_joules_total"], data.EnergyJoules, created, labels...)
+		newGauge(ch, phasesDesc["nominal_volts"], data.NominalVoltageVolts, labels...)
 		newGauge(ch, phasesDesc["power_factor"], data.PowerFactor, labels...)
-		newGauge(ch, phasesDesc["volts"], data.Voltage, labels...)
-		newGauge(ch, phasesDesc["volts_deviation"], data.VoltageDeviation, labels...)
+		newGauge(ch, phasesDesc["volts"], data.VoltageVolts, labels...)
+		newGauge(ch, phasesDesc["volts_deviation"], data.voltageDeviationPercent, labels...)
 
 		reactanceMetric(ch, phasesDesc["reactance"], data.Reactance, labels)
 
-		statusMetric(ch, phasesDesc["status"], data.PowerFactorStatus, "power factor", labels)
-		statusMetric(ch, phasesDesc["status"], data.VoltageStatus, "voltage", labels)
-		statusMetric(ch, phasesDesc["status"], data.Status, "phase", labels)
+		statusMetrics(ch, phasesDesc["status"], data.Statuses, labels)
 
 		stateMetric(ch, phasesDesc["state"], data.State, labels)
 	}
-	return nil
 }
 
-type phasesData []struct {
+type phasesData []phaseData
+
+type phaseData struct {
 	ID                string  `json:"id"`
 	Name              string  `json:"name"`
 	ActivePower       float64 `json:"active_power"`
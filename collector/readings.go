@@ -0,0 +1,247 @@
+package collector
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tynany/servertech_exporter/config"
+)
+
+// Readings are the readings of a PDU, normalised to SI units and ratios, with lower case states and statuses.
+// Subsystems whose collector is disabled are omitted.
+type Readings struct {
+	Target   string           `json:"target"`
+	Time     time.Time        `json:"time"`
+	System   *SystemReadings  `json:"system,omitempty"`
+	Units    []UnitReadings   `json:"units,omitempty"`
+	Cords    []CordReadings   `json:"cords,omitempty"`
+	Lines    []LineReadings   `json:"lines,omitempty"`
+	Phases   []PhaseReadings  `json:"phases,omitempty"`
+	Branches []BranchReadings `json:"branches,omitempty"`
+	Ocps     []OcpReadings    `json:"ocps,omitempty"`
+	Outlets  []OutletReadings `json:"outlets,omitempty"`
+	// Errors by subsystem, for subsystems that could not be read.
+	Errors map[string]string `json:"errors,omitempty"`
+
+	// errs are the errors of the subsystems that could not be read, and durations the time taken to read each
+	// subsystem, reported by the collectors.
+	errs      map[string]error
+	durations map[string]time.Duration
+	// suppressedOutletSeries is the number of outlet series not exported because the outlet was filtered out.
+	suppressedOutletSeries int
+}
+
+// Entity identifies a unit, cord, line, phase, branch, OCP or outlet of a PDU.
+type Entity struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	UnitID   string `json:"unit_id"`
+	CordID   string `json:"cord_id"`
+	Position string `json:"position"`
+}
+
+func newEntity(id, name string) Entity {
+	l := idLabels(id)
+	return Entity{ID: id, Name: name, UnitID: l[0], CordID: l[1], Position: l[2]}
+}
+
+// idLabels returns the unit_id, cord_id and position label values of the entity.
+func (e Entity) idLabels() []string {
+	return []string{e.UnitID, e.CordID, e.Position}
+}
+
+// SystemReadings are the readings of the PDU as a whole.
+type SystemReadings struct {
+	Firmware        string            `json:"firmware"`
+	NicSerialNumber string            `json:"nic_serial_number"`
+	ActiveUsers     float64           `json:"active_users"`
+	UptimeSeconds   float64           `json:"uptime_seconds"`
+	Statuses        map[string]string `json:"statuses"`
+}
+
+// UnitReadings are the readings of a master or link unit.
+type UnitReadings struct {
+	Entity
+	Type               string            `json:"type"`
+	DisplayOrientation string            `json:"display_orientation"`
+	Statuses           map[string]string `json:"statuses"`
+}
+
+// CordReadings are the readings of an input cord.
+type CordReadings struct {
+	Entity
+	PlugType                 string            `json:"plug_type"`
+	ActivePowerWatts         float64           `json:"active_power_watts"`
+	ApparentPowerVoltAmperes float64           `json:"apparent_power_voltamperes"`
+	PowerCapacityWatts       float64           `json:"power_capacity_watts"`
+	PowerUtilizationRatio    float64           `json:"power_utilization_ratio"`
+	PowerFactor              float64           `json:"power_factor"`
+	EnergyJoules             float64           `json:"energy_joules"`
+	FrequencyHertz           float64           `json:"frequency_hertz"`
+	ThreePhaseImbalanceRatio float64           `json:"three_phase_imbalance_ratio"`
+	State                    string            `json:"state"`
+	Statuses                 map[string]string `json:"statuses"`
+
+	// Readings in the units reported by the PDU, for metrics that keep them.
+	energyKilowattHours        float64
+	threePhaseImbalancePercent float64
+}
+
+// LineReadings are the readings of an input line.
+type LineReadings struct {
+	Entity
+	CurrentAmperes          float64           `json:"current_amperes"`
+	CurrentCapacityAmperes  float64           `json:"current_capacity_amperes"`
+	CurrentUtilizationRatio float64           `json:"current_utilization_ratio"`
+	State                   string            `json:"state"`
+	Statuses                map[string]string `json:"statuses"`
+}
+
+// PhaseReadings are the readings of a phase.
+type PhaseReadings struct {
+	Entity
+	ActivePowerWatts         float64           `json:"active_power_watts"`
+	ApparentPowerVoltAmperes float64           `json:"apparent_power_voltamperes"`
+	CurrentAmperes           float64           `json:"current_amperes"`
+	VoltageVolts             float64           `json:"voltage_volts"`
+	NominalVoltageVolts      float64           `json:"nominal_voltage_volts"`
+	VoltageDeviationRatio    float64           `json:"voltage_deviation_ratio"`
+	PowerFactor              float64           `json:"power_factor"`
+	CrestFactor              float64           `json:"crest_factor"`
+	Reactance                string            `json:"reactance"`
+	EnergyJoules             float64           `json:"energy_joules"`
+	State                    string            `json:"state"`
+	Statuses                 map[string]string `json:"statuses"`
+
+	// Readings in the units reported by the PDU, for metrics that keep them.
+	energyKilowattHours     float64
+	voltageDeviationPercent float64
+}
+
+// BranchReadings are the readings of a branch.
+type BranchReadings struct {
+	Entity
+	PhaseID                 string            `json:"phase_id"`
+	OcpID                   string            `json:"ocp_id"`
+	CurrentAmperes          float64           `json:"current_amperes"`
+	CurrentCapacityAmperes  float64           `json:"current_capacity_amperes"`
+	CurrentUtilizationRatio float64           `json:"current_utilization_ratio"`
+	State                   string            `json:"state"`
+	Statuses                map[string]string `json:"statuses"`
+}
+
+// OcpReadings are the readings of an over current protector.
+type OcpReadings struct {
+	Entity
+	Type                   string            `json:"type"`
+	CurrentAmperes         float64           `json:"current_amperes"`
+	CurrentCapacityAmperes float64           `json:"current_capacity_amperes"`
+	State                  string            `json:"state"`
+	Statuses               map[string]string `json:"statuses"`
+}
+
+// OutletReadings are the readings of an outlet.
+type OutletReadings struct {
+	Entity
+	BranchID                 string            `json:"branch_id"`
+	OcpID                    string            `json:"ocp_id"`
+	PhaseID                  string            `json:"phase_id"`
+	SocketType               string            `json:"socket_type"`
+	SocketAdapter            string            `json:"socket_adapter"`
+	Host                     string            `json:"host,omitempty"`
+	AssetTag                 string            `json:"asset_tag,omitempty"`
+	Team                     string            `json:"team,omitempty"`
+	ActivePowerWatts         float64           `json:"active_power_watts"`
+	ApparentPowerVoltAmperes float64           `json:"apparent_power_voltamperes"`
+	PowerCapacityWatts       float64           `json:"power_capacity_watts"`
+	CurrentAmperes           float64           `json:"current_amperes"`
+	CurrentCapacityAmperes   float64           `json:"current_capacity_amperes"`
+	CurrentUtilizationRatio  float64           `json:"current_utilization_ratio"`
+	VoltageVolts             float64           `json:"voltage_volts"`
+	PowerFactor              float64           `json:"power_factor"`
+	CrestFactor              float64           `json:"crest_factor"`
+	Reactance                string            `json:"reactance"`
+	EnergyJoules             float64           `json:"energy_joules"`
+	State                    string            `json:"state"`
+	ControlState             string            `json:"control_state"`
+	Statuses                 map[string]string `json:"statuses"`
+
+	// Reading in the unit reported by the PDU, for metrics that keep it.
+	energyKilowattHours float64
+}
+
+// GetReadings queries the subsystems of a PDU that have their collector enabled, and returns their readings. Outlets
+// are filtered by module, which may be nil. Subsystems that cannot be read are reported in Readings.Errors. Requests
+// are logged to logger, or slog.Default() if nil.
+func GetReadings(logger *slog.Logger, target, user, pass string, module *config.Module) *Readings {
+	var subsystems []string
+	for name, enabled := range collectorState {
+		if *enabled {
+			subsystems = append(subsystems, name)
+		}
+	}
+	return readSubsystems(targetLogger(logger, target, module), target, user, pass, module, subsystems)
+}
+
+// jawsGetter unmarshals the response to a request for path of the JAWS monitor API of a PDU into v.
+type jawsGetter func(path string, v interface{}) error
+
+// reader reads the readings of a subsystem of a PDU into r, decoding and transforming the JAWS API response.
+// Readers are shared by the collectors and GetReadings, so that metrics and readings are always consistent.
+type reader func(r *Readings, get jawsGetter, module *config.Module) error
+
+// readSubsystems queries subsystems of a PDU concurrently, and returns their readings. Requests are logged to logger,
+// which should have the target and module added, with the collector of the subsystem.
+func readSubsystems(logger *slog.Logger, target, user, pass string, module *config.Module, subsystems []string) *Readings {
+	r := &Readings{
+		Target:    target,
+		Time:      time.Now(),
+		errs:      make(map[string]error),
+		durations: make(map[string]time.Duration),
+	}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, subsystem := range subsystems {
+		read, ok := readers[subsystem]
+		if !ok {
+			continue
+		}
+		get := func(path string, v interface{}) error {
+			return getServerTechData(logger.With("collector", subsystem), target, user, pass, path, v)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := read(r, get, module)
+			mu.Lock()
+			defer mu.Unlock()
+			r.durations[subsystem] = time.Since(start)
+			if err != nil {
+				r.errs[subsystem] = err
+				if r.Errors == nil {
+					r.Errors = make(map[string]string)
+				}
+				r.Errors[subsystem] = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	return r
+}
+
+// statuses returns a map of status types to lower case statuses from alternating status type and status arguments.
+// Statuses that are not reported by the PDU are omitted.
+func statuses(typeStatusPairs ...string) map[string]string {
+	m := make(map[string]string, len(typeStatusPairs)/2)
+	for i := 0; i+1 < len(typeStatusPairs); i += 2 {
+		if typeStatusPairs[i+1] != "" {
+			m[typeStatusPairs[i]] = strings.ToLower(typeStatusPairs[i+1])
+		}
+	}
+	return m
+}
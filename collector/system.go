@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/config"
 )
 
 var (
@@ -17,90 +19,112 @@ var (
 
 	systemDesc = map[string]*prometheus.Desc{
 		"active_users":   colPromDesc(systemSubsystem, "active_users", "Integer number of active users logged in.", systemLabels),
-		"uptime_seconds": colPromDesc(systemSubsystem, "voltamps", "System uptime", systemLabels),
+		"uptime_seconds": colPromDesc(systemSubsystem, "uptime_seconds", "System uptime in seconds.", systemLabels),
 		"status":         colPromDesc(systemSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", systemStatusLabels),
 	}
 
-	totalSystemErrors = 0.0
+	totalSystemErrors atomic.Uint64
+
+	uptimeRegex = regexp.MustCompile("(?:(.*) days? )?(?:(.*) hours? )?(?:(.*) minutes? )?(.*) seconds?")
 )
 
 func init() {
-	registerCollector(systemSubsystem, enabledByDefault, NewSystemCollector)
+	registerCollector(systemSubsystem, enabledByDefault, NewSystemCollector, readSystem)
 }
 
 // SystemCollector collects system metrics, implemented as per the Collector interface.
 type SystemCollector struct{}
 
 // NewSystemCollector returns a new SystemCollector.
-func NewSystemCollector() Collector {
+func NewSystemCollector(module *config.Module) Collector {
 	return &SystemCollector{}
 }
 
 // Get metrics and send to the Prometheus.Metric channel.
-func (c *SystemCollector) Get(ch chan<- prometheus.Metric, target, user, pass string) (float64, error) {
+func (c *SystemCollector) Get(ch chan<- prometheus.Metric, r *Readings) (float64, error) {
+	if err := r.errs[systemSubsystem]; err != nil {
+		return float64(totalSystemErrors.Add(1)), err
+	}
+	recordFirmware(r.Target, r.System.Firmware)
+	processSystemStats(ch, r.System)
+	return float64(totalSystemErrors.Load()), nil
+}
 
-	jsonSystem, err := getServerTechJSON(target, user, pass, "system")
+// ProbeSystem queries the system endpoint of a PDU, returning its firmware version. Request errors wrap the
+// underlying error, and unexpected status codes are returned as a *StatusError.
+func ProbeSystem(target, user, pass string) (string, error) {
+	body, err := getServerTechJSON(targetLogger(nil, target, nil), target, user, pass, systemSubsystem)
 	if err != nil {
-		totalSystemErrors++
-		return totalSystemErrors, fmt.Errorf("cannot get systems: %s", err)
+		return "", err
 	}
-
-	if err := processSystemStats(ch, jsonSystem); err != nil {
-		totalSystemErrors++
-		return totalSystemErrors, err
+	var data systemData
+	if err := json.Unmarshal(body, &data); err != nil {
+		return "", fmt.Errorf("cannot unmarshal system json: %s", err)
 	}
-	return totalSystemErrors, nil
-
+	return data.Firmware, nil
 }
 
-func processSystemStats(ch chan<- prometheus.Metric, jsonSystemSum []byte) error {
+// readSystem reads the system of a PDU into r.
+func readSystem(r *Readings, get jawsGetter, module *config.Module) error {
 	var data systemData
-	if err := json.Unmarshal(jsonSystemSum, &data); err != nil {
-		return fmt.Errorf("cannot unmarshal system json: %s", err)
+	if err := get(systemSubsystem, &data); err != nil {
+		return err
 	}
-	labels := []string{data.Firmware, data.NicSerialNumber}
+	uptime, err := parseUptime(data.Uptime)
+	if err != nil {
+		return err
+	}
+	r.System = &SystemReadings{
+		Firmware:        data.Firmware,
+		NicSerialNumber: data.NicSerialNumber,
+		ActiveUsers:     data.ActiveUsers,
+		UptimeSeconds:   uptime,
+		Statuses: statuses(
+			"branches", data.StatusBranches,
+			"cords", data.StatusCords,
+			"lines", data.StatusLines,
+			"ocps", data.StatusOcps,
+			"outlets", data.StatusOutlets,
+			"phases", data.StatusPhases,
+			"units", data.StatusUnits,
+		),
+	}
+	return nil
+}
 
-	newGauge(ch, systemDesc["active_users"], data.ActiveUsers, labels...)
+// processSystemStats sends the system metrics.
+func processSystemStats(ch chan<- prometheus.Metric, system *SystemReadings) {
+	labels := []string{system.Firmware, system.NicSerialNumber}
 
-	statusMetric(ch, systemDesc["status"], data.StatusBranches, "branches", labels)
-	statusMetric(ch, systemDesc["status"], data.StatusCords, "cords", labels)
-	statusMetric(ch, systemDesc["status"], data.StatusLines, "lines", labels)
-	statusMetric(ch, systemDesc["status"], data.StatusOcps, "ocps", labels)
-	statusMetric(ch, systemDesc["status"], data.StatusOutlets, "outlets", labels)
-	statusMetric(ch, systemDesc["status"], data.StatusPhases, "phases", labels)
-	statusMetric(ch, systemDesc["status"], data.StatusUnits, "units", labels)
+	newGauge(ch, systemDesc["active_users"], system.ActiveUsers, labels...)
 
-	r, err := regexp.Compile("(?:(.*) days )?(?:(.*) hours )?(?:(.*) minutes )?(.*) seconds")
-	if err != nil {
-		return fmt.Errorf("could not compile uptime regex: %v", err)
-	}
-	reUptime := r.FindStringSubmatch(data.Uptime)
+	statusMetrics(ch, systemDesc["status"], system.Statuses, labels)
 
-	if len(reUptime) < 4 {
-		return fmt.Errorf("uptime data was not in expected format: %v", data.Uptime)
-	}
+	newGauge(ch, systemDesc["uptime_seconds"], system.UptimeSeconds, labels...)
+}
 
-	uptimeDays, err := strconv.Atoi(reUptime[1])
-	if err != nil {
-		return fmt.Errorf("could not convert uptime day to int: %v", err)
-	}
-	uptimeHours, err := strconv.Atoi(reUptime[2])
-	if err != nil {
-		return fmt.Errorf("could not convert uptime hour to int: %v", err)
-	}
-	uptimeMinutes, err := strconv.Atoi(reUptime[3])
-	if err != nil {
-		return fmt.Errorf("could not convert uptime minute to int: %v", err)
-	}
-	uptimeSeconds, err := strconv.Atoi(reUptime[4])
-	if err != nil {
-		return fmt.Errorf("could not convert uptime second to int: %v", err)
+// parseUptime returns the number of seconds in a JAWS uptime string, e.g. "3 days 2 hours 5 minutes 7 seconds".
+func parseUptime(uptimeStr string) (float64, error) {
+	reUptime := uptimeRegex.FindStringSubmatch(uptimeStr)
+	if reUptime == nil {
+		return 0, fmt.Errorf("uptime data was not in expected format: %v", uptimeStr)
 	}
-	uptime := (uptimeDays * 86400) + (uptimeHours * 3600) + (uptimeMinutes * 60) + uptimeSeconds
 
-	newCounter(ch, systemDesc["uptime_seconds"], float64(uptime), labels...)
-
-	return nil
+	uptime := 0
+	for i, unit := range []struct {
+		name    string
+		seconds int
+	}{{"day", 86400}, {"hour", 3600}, {"minute", 60}, {"second", 1}} {
+		if reUptime[i+1] == "" {
+			continue
+		}
+		value, err := strconv.Atoi(reUptime[i+1])
+		if err != nil {
+			return 0, fmt.Errorf("could not convert uptime %s to int: %v", unit.name, err)
+		}
+		uptime += value * unit.seconds
+	}
+	return float64(uptime), nil
 }
 
 type systemData struct {
@@ -0,0 +1,82 @@
+package collector
+
+import (
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+)
+
+// maxTargets is the number of targets state is kept for, so that requests for arbitrary targets cannot grow memory
+// and series without bound. The state of the least recently scraped target is dropped first.
+const maxTargets = 10000
+
+var (
+	targetStateTTL = kingpin.Flag("servertech.target-state-ttl", "Time the state of a target, such as its JAWS request histograms and the created timestamp of its counters, is kept after it was last scraped.").Default("1h").Duration()
+
+	targets = &targetStates{states: make(map[string]*targetState)}
+)
+
+// targetState is the state kept for a scraped target.
+type targetState struct {
+	// firstSeen is the time the target was first scraped, used as the created timestamp of its counters.
+	firstSeen time.Time
+	lastSeen  time.Time
+	jaws      *jawsRequestMetrics
+	// firmware of the PDU when it was last scraped by the system collector, guarded by targetStates.mu.
+	firmware string
+}
+
+// targetStates is the state of scraped targets, bounded by the target state TTL and maxTargets.
+type targetStates struct {
+	mu     sync.Mutex
+	states map[string]*targetState
+	// swept is when the states of targets not scraped within the TTL were last dropped.
+	swept time.Time
+}
+
+// get returns the state of target, adding it if it is not kept, and marks target as scraped.
+func (s *targetStates) get(target string) *targetState {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.swept) > time.Minute {
+		for t, state := range s.states {
+			if now.Sub(state.lastSeen) > *targetStateTTL {
+				delete(s.states, t)
+			}
+		}
+		s.swept = now
+	}
+	state, ok := s.states[target]
+	if !ok {
+		if len(s.states) >= maxTargets {
+			s.dropLeastRecent()
+		}
+		state = &targetState{firstSeen: now, jaws: newJAWSRequestMetrics()}
+		s.states[target] = state
+	}
+	state.lastSeen = now
+	return state
+}
+
+func (s *targetStates) dropLeastRecent() {
+	var oldest string
+	for t, state := range s.states {
+		if oldest == "" || state.lastSeen.Before(s.states[oldest].lastSeen) {
+			oldest = t
+		}
+	}
+	delete(s.states, oldest)
+}
+
+// targetFirstSeen returns the time target was first scraped, used as the created timestamp of the target's counters.
+func targetFirstSeen(target string) time.Time {
+	return targets.get(target).firstSeen
+}
+
+// targetJAWSMetrics returns the JAWS API request metrics of target, collected when the target is scraped.
+func targetJAWSMetrics(target string) *jawsRequestMetrics {
+	return targets.get(target).jaws
+}
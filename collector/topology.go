@@ -0,0 +1,221 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// Topology is the physical layout of a PDU, from its units down to its outlets.
+type Topology struct {
+	Target string          `json:"target"`
+	Units  []*TopologyUnit `json:"units"`
+}
+
+// TopologyUnit is a master or link PDU.
+type TopologyUnit struct {
+	ID    string          `json:"id"`
+	Name  string          `json:"name"`
+	Type  string          `json:"type"`
+	Cords []*TopologyCord `json:"cords"`
+}
+
+// TopologyCord is an input cord of a unit.
+type TopologyCord struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	PlugType string            `json:"plug_type"`
+	Lines    []TopologyLine    `json:"lines"`
+	Phases   []TopologyPhase   `json:"phases"`
+	Ocps     []TopologyOcp     `json:"ocps"`
+	Branches []*TopologyBranch `json:"branches"`
+	// Outlets that are not fed by a branch.
+	Outlets []TopologyOutlet `json:"outlets"`
+}
+
+// TopologyLine is an input line of a cord.
+type TopologyLine struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// TopologyPhase is a phase of a cord.
+type TopologyPhase struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// TopologyOcp is an over current protector (fuse or breaker) of a cord.
+type TopologyOcp struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// TopologyBranch is a branch of a cord, fed by a phase and protected by an OCP.
+type TopologyBranch struct {
+	ID      string           `json:"id"`
+	Name    string           `json:"name"`
+	PhaseID string           `json:"phase_id"`
+	OcpID   string           `json:"ocp_id"`
+	Outlets []TopologyOutlet `json:"outlets"`
+}
+
+// TopologyOutlet is an outlet fed by a branch.
+type TopologyOutlet struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	BranchID      string `json:"branch_id"`
+	PhaseID       string `json:"phase_id"`
+	OcpID         string `json:"ocp_id"`
+	SocketType    string `json:"socket_type"`
+	SocketAdapter string `json:"socket_adapter"`
+}
+
+// topologySubsystems are the subsystems the topology of a PDU is built from.
+var topologySubsystems = []string{
+	unitsSubsystem, cordsSubsystem, linesSubsystem, phasesSubsystem, ocpsSubsystem, branchesSubsystem, outletsSubsystem,
+}
+
+// GetTopology queries a PDU and returns its topology. Requests are logged to logger, or slog.Default() if nil.
+func GetTopology(logger *slog.Logger, target, user, pass string) (*Topology, error) {
+	return GetTopologyReadings(logger, target, user, pass).Topology()
+}
+
+// GetTopologyReadings queries the subsystems of a PDU its topology is built from, whether or not their collector is
+// enabled, and returns their readings. Outlets are not filtered. Requests are logged to logger, or slog.Default() if
+// nil.
+func GetTopologyReadings(logger *slog.Logger, target, user, pass string) *Readings {
+	return readSubsystems(targetLogger(logger, target, nil), target, user, pass, nil, topologySubsystems)
+}
+
+// Topology returns the topology of the PDU the readings are of, which must include every subsystem read by
+// GetTopologyReadings. Entities are placed in the tree using the unit and cord encoded in their ID, such as "AA" of
+// "AA:BR1". Entities with IDs that do not encode a unit and cord, or a unit for units, are logged and not included.
+func (r *Readings) Topology() (*Topology, error) {
+	for _, subsystem := range topologySubsystems {
+		if err := r.errs[subsystem]; err != nil {
+			return nil, err
+		}
+		if _, ok := r.durations[subsystem]; !ok {
+			return nil, fmt.Errorf("cannot build topology without %s readings", subsystem)
+		}
+	}
+
+	t := &Topology{Target: r.Target, Units: []*TopologyUnit{}}
+	unplaced := func(subsystem, id string) {
+		slog.Warn("cannot place entity in topology, as its ID does not encode its unit and cord",
+			"target", r.Target, "subsystem", subsystem, "id", id)
+	}
+	cord := func(subsystem, id string) *TopologyCord {
+		cord := t.cord(id)
+		if cord == nil {
+			unplaced(subsystem, id)
+		}
+		return cord
+	}
+
+	for _, u := range r.Units {
+		if unit := t.unit(u.ID); unit != nil {
+			unit.Name, unit.Type = u.Name, u.Type
+		} else {
+			unplaced(unitsSubsystem, u.ID)
+		}
+	}
+	for _, c := range r.Cords {
+		if cord := cord(cordsSubsystem, c.ID); cord != nil {
+			cord.Name, cord.PlugType = c.Name, c.PlugType
+		}
+	}
+	for _, l := range r.Lines {
+		if cord := cord(linesSubsystem, l.ID); cord != nil {
+			cord.Lines = append(cord.Lines, TopologyLine{ID: l.ID, Name: l.Name})
+		}
+	}
+	for _, p := range r.Phases {
+		if cord := cord(phasesSubsystem, p.ID); cord != nil {
+			cord.Phases = append(cord.Phases, TopologyPhase{ID: p.ID, Name: p.Name})
+		}
+	}
+	for _, o := range r.Ocps {
+		if cord := cord(ocpsSubsystem, o.ID); cord != nil {
+			cord.Ocps = append(cord.Ocps, TopologyOcp{ID: o.ID, Name: o.Name, Type: o.Type})
+		}
+	}
+	branchByID := make(map[string]*TopologyBranch)
+	for _, b := range r.Branches {
+		if cord := cord(branchesSubsystem, b.ID); cord != nil {
+			branch := &TopologyBranch{ID: b.ID, Name: b.Name, PhaseID: b.PhaseID, OcpID: b.OcpID, Outlets: []TopologyOutlet{}}
+			cord.Branches = append(cord.Branches, branch)
+			branchByID[b.ID] = branch
+		}
+	}
+	for _, o := range r.Outlets {
+		outlet := TopologyOutlet{
+			ID:            o.ID,
+			Name:          o.Name,
+			BranchID:      o.BranchID,
+			PhaseID:       o.PhaseID,
+			OcpID:         o.OcpID,
+			SocketType:    o.SocketType,
+			SocketAdapter: o.SocketAdapter,
+		}
+		if branch, ok := branchByID[o.BranchID]; ok {
+			branch.Outlets = append(branch.Outlets, outlet)
+		} else if cord := cord(outletsSubsystem, o.ID); cord != nil {
+			cord.Outlets = append(cord.Outlets, outlet)
+		}
+	}
+	return t, nil
+}
+
+// unit returns the unit with the unit ID encoded in id, adding it if it does not exist.
+func (t *Topology) unit(id string) *TopologyUnit {
+	unitID := idLabels(id)[0]
+	if unitID == "" {
+		return nil
+	}
+	for _, u := range t.Units {
+		if u.ID == unitID {
+			return u
+		}
+	}
+	u := &TopologyUnit{ID: unitID, Cords: []*TopologyCord{}}
+	t.Units = append(t.Units, u)
+	return u
+}
+
+// cord returns the cord with the cord ID encoded in id, adding it and its unit if they do not exist.
+func (t *Topology) cord(id string) *TopologyCord {
+	cordID := idLabels(id)[1]
+	if cordID == "" {
+		return nil
+	}
+	u := t.unit(id)
+	for _, c := range u.Cords {
+		if c.ID == cordID {
+			return c
+		}
+	}
+	c := &TopologyCord{
+		ID:       cordID,
+		Lines:    []TopologyLine{},
+		Phases:   []TopologyPhase{},
+		Ocps:     []TopologyOcp{},
+		Branches: []*TopologyBranch{},
+		Outlets:  []TopologyOutlet{},
+	}
+	u.Cords = append(u.Cords, c)
+	return c
+}
+
+func getServerTechData(logger *slog.Logger, target, user, pass, path string, v interface{}) error {
+	body, err := getServerTechJSON(logger, target, user, pass, path)
+	if err != nil {
+		return fmt.Errorf("cannot get %s: %w", path, err)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("cannot unmarshal %s json: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package collector
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func entity(id string) Entity {
+	return newEntity(id, id)
+}
+
+func topologyReadings() *Readings {
+	r := &Readings{
+		Target:    "pdu1",
+		errs:      map[string]error{},
+		durations: map[string]time.Duration{},
+		Units:     []UnitReadings{{Entity: entity("A"), Type: "master"}},
+		Cords:     []CordReadings{{Entity: entity("AA")}, {Entity: entity("AB")}},
+		Lines:     []LineReadings{{Entity: entity("AA:L1")}, {Entity: entity("AA:L2")}, {Entity: entity("AB:L1")}},
+		Phases:    []PhaseReadings{{Entity: entity("AA:L1-L2")}, {Entity: entity("AB:L1-N")}},
+		Ocps:      []OcpReadings{{Entity: entity("AA:CB1"), Type: "breaker"}},
+		Branches: []BranchReadings{
+			{Entity: entity("AA:BR1"), PhaseID: "AA:L1-L2", OcpID: "AA:CB1"},
+			{Entity: entity("AA:BR2"), PhaseID: "AA:L1-L2", OcpID: "AA:CB1"},
+			// Not placed, as the ID does not encode a cord.
+			{Entity: entity("A:BR1")},
+		},
+		Outlets: []OutletReadings{
+			{Entity: entity("AA1"), BranchID: "AA:BR1"},
+			{Entity: entity("AA2"), BranchID: "AA:BR2"},
+			{Entity: entity("AA3"), BranchID: "AA:BR2"},
+			// Outlets without a branch are placed under their cord.
+			{Entity: entity("AB1")},
+		},
+	}
+	for _, subsystem := range topologySubsystems {
+		r.durations[subsystem] = time.Millisecond
+	}
+	return r
+}
+
+func TestTopology(t *testing.T) {
+	topology, err := topologyReadings().Topology()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(topology.Units) != 1 || topology.Units[0].ID != "A" || topology.Units[0].Type != "master" {
+		t.Fatalf("expected master unit A, got %+v", topology.Units)
+	}
+	cords := topology.Units[0].Cords
+	if len(cords) != 2 || cords[0].ID != "AA" || cords[1].ID != "AB" {
+		t.Fatalf("expected cords AA and AB, got %+v", cords)
+	}
+
+	// ids returns the IDs of a slice of topology entities.
+	ids := func(v interface{}) []string {
+		var ids []string
+		s := reflect.ValueOf(v)
+		for i := 0; i < s.Len(); i++ {
+			ids = append(ids, reflect.Indirect(s.Index(i)).FieldByName("ID").String())
+		}
+		return ids
+	}
+	for _, test := range []struct {
+		name     string
+		got      interface{}
+		expected []string
+	}{
+		{"AA lines", cords[0].Lines, []string{"AA:L1", "AA:L2"}},
+		{"AA phases", cords[0].Phases, []string{"AA:L1-L2"}},
+		{"AA ocps", cords[0].Ocps, []string{"AA:CB1"}},
+		{"AA branches", cords[0].Branches, []string{"AA:BR1", "AA:BR2"}},
+		{"AA outlets", cords[0].Outlets, nil},
+		{"AA:BR1 outlets", cords[0].Branches[0].Outlets, []string{"AA1"}},
+		{"AA:BR2 outlets", cords[0].Branches[1].Outlets, []string{"AA2", "AA3"}},
+		{"AB lines", cords[1].Lines, []string{"AB:L1"}},
+		{"AB phases", cords[1].Phases, []string{"AB:L1-N"}},
+		{"AB branches", cords[1].Branches, nil},
+		{"AB outlets", cords[1].Outlets, []string{"AB1"}},
+	} {
+		if got := ids(test.got); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestTopologyMissingSubsystem(t *testing.T) {
+	r := topologyReadings()
+	delete(r.durations, ocpsSubsystem)
+	if _, err := r.Topology(); err == nil {
+		t.Error("expected error without ocps readings")
+	}
+}
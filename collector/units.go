@@ -1,93 +1,102 @@
 package collector
 
 import (
-	"encoding/json"
-	"fmt"
 	"strings"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/config"
 )
 
 var (
 	unitsSubsystem = "units"
 
-	unitsLabels       = []string{"id", "name", "type"}
+	unitsLabels       = []string{"id", "name", "type", "unit_id", "cord_id", "position"}
 	unitsStatusLabels = append(unitsLabels, "status_type")
 
 	unitsDesc = map[string]*prometheus.Desc{
+		"info":                colPromDesc(unitsSubsystem, "info", "Unit topology and identifying information, for joining with other unit metrics (always 1).", unitsLabels),
 		"display_orientation": colPromDesc(unitsSubsystem, "display_orientation", "0 = Unknown, 1 = Auto (inverted), 2 = Auto (Normal), 3 = Inverted, 4 = Normal.", unitsLabels),
 		"unit_sequence":       colPromDesc(unitsSubsystem, "unit_sequence", "0 = Unknown, 1 = Normal, 2 = Reversed.", unitsLabels),
 		"status":              colPromDesc(unitsSubsystem, "status", "Status (1 = Normal, 0 = Not Normal).", unitsStatusLabels),
 	}
 
-	totalUnitsErrors = 0.0
+	totalUnitsErrors atomic.Uint64
 )
 
 func init() {
-	registerCollector(unitsSubsystem, enabledByDefault, NewUnitsCollector)
+	registerCollector(unitsSubsystem, enabledByDefault, NewUnitsCollector, readUnits)
 }
 
 // UnitsCollector collects units metrics, implemented as per the Collector interface.
 type UnitsCollector struct{}
 
 // NewUnitsCollector returns a new UnitsCollector.
-func NewUnitsCollector() Collector {
+func NewUnitsCollector(module *config.Module) Collector {
 	return &UnitsCollector{}
 }
 
 // Get metrics and send to the Prometheus.Metric channel.
-func (c *UnitsCollector) Get(ch chan<- prometheus.Metric, target, user, pass string) (float64, error) {
-
-	jsonUnits, err := getServerTechJSON(target, user, pass, "units")
-	if err != nil {
-		totalUnitsErrors++
-		return totalUnitsErrors, fmt.Errorf("cannot get unitss: %s", err)
+func (c *UnitsCollector) Get(ch chan<- prometheus.Metric, r *Readings) (float64, error) {
+	if err := r.errs[unitsSubsystem]; err != nil {
+		return float64(totalUnitsErrors.Add(1)), err
 	}
+	processUnitsStats(ch, r.Units)
+	return float64(totalUnitsErrors.Load()), nil
+}
 
-	if err := processUnitsStats(ch, jsonUnits); err != nil {
-		totalUnitsErrors++
-		return totalUnitsErrors, err
+// readUnits reads the master and link units of a PDU into r.
+func readUnits(r *Readings, get jawsGetter, module *config.Module) error {
+	var data unitsData
+	if err := get(unitsSubsystem, &data); err != nil {
+		return err
 	}
-	return totalUnitsErrors, nil
-
+	r.Units = make([]UnitReadings, 0, len(data))
+	for _, d := range data {
+		r.Units = append(r.Units, UnitReadings{
+			Entity:             newEntity(d.ID, d.Name),
+			Type:               d.Type,
+			DisplayOrientation: strings.ToLower(d.DisplayOrientation),
+			Statuses:           statuses("unit", d.Status),
+		})
+	}
+	return nil
 }
 
-func processUnitsStats(ch chan<- prometheus.Metric, jsonUnitsSum []byte) error {
-	var jsonUnits unitsData
+func processUnitsStats(ch chan<- prometheus.Metric, units []UnitReadings) {
+	for _, data := range units {
+		labels := append([]string{data.ID, data.Name, data.Type}, data.idLabels()...)
 
-	if err := json.Unmarshal(jsonUnitsSum, &jsonUnits); err != nil {
-		return fmt.Errorf("cannot unmarshal units json: %s", err)
-	}
-	for _, data := range jsonUnits {
-		labels := []string{data.ID, data.Name, data.Type}
+		newGauge(ch, unitsDesc["info"], 1, labels...)
 
 		displayOrientation := float64(0)
-		if strings.ToLower(data.DisplayOrientation) == "auto (inverted)" {
+		if data.DisplayOrientation == "auto (inverted)" {
 			displayOrientation = 1
-		} else if strings.ToLower(data.DisplayOrientation) == "auto (normal)" {
+		} else if data.DisplayOrientation == "auto (normal)" {
 			displayOrientation = 2
-		} else if strings.ToLower(data.DisplayOrientation) == "inverted" {
+		} else if data.DisplayOrientation == "inverted" {
 			displayOrientation = 3
-		} else if strings.ToLower(data.DisplayOrientation) == "normal" {
+		} else if data.DisplayOrientation == "normal" {
 			displayOrientation = 4
 		}
 		newGauge(ch, unitsDesc["display_orientation"], displayOrientation, labels...)
 
 		unitSequence := float64(0)
-		if strings.ToLower(data.DisplayOrientation) == "normal" {
+		if data.DisplayOrientation == "normal" {
 			unitSequence = 1
-		} else if strings.ToLower(data.DisplayOrientation) == "reversed" {
+		} else if data.DisplayOrientation == "reversed" {
 			unitSequence = 2
 		}
 		newGauge(ch, unitsDesc["unit_sequence"], unitSequence, labels...)
 
-		statusMetric(ch, unitsDesc["status"], data.Status, "unit", labels)
+		statusMetrics(ch, unitsDesc["status"], data.Statuses, labels)
 
 	}
-	return nil
 }
 
-type unitsData []struct {
+type unitsData []unitData
+
+type unitData struct {
 	ID                 string `json:"id"`
 	Name               string `json:"name"`
 	DisplayOrientation string `json:"display_orientation"`
@@ -0,0 +1,233 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultModule is the module used when none is requested or configured for a target.
+const DefaultModule = "default"
+
+// reservedLabels are the label names of the exporter's metrics, which target labels must not use.
+var reservedLabels = make(map[string]bool)
+
+// ReserveLabels reserves label names used by the exporter's metrics, so that configuration files setting them as
+// target labels are rejected rather than producing metrics with clashing labels.
+func ReserveLabels(names ...string) {
+	for _, name := range names {
+		reservedLabels[name] = true
+	}
+}
+
+// Config is the servertech_exporter configuration file.
+type Config struct {
+	Modules map[string]*Module `yaml:"modules,omitempty"`
+	Targets []*Target          `yaml:"targets,omitempty"`
+	// Directory of credential files, e.g. a mounted Kubernetes secret, used for credentials not in Targets.
+	SecretsDir string `yaml:"secrets_dir,omitempty"`
+}
+
+// Module configures how PDUs are scraped.
+type Module struct {
+	// Name of the module in the configuration file.
+	Name    string        `yaml:"-"`
+	Outlets OutletsFilter `yaml:"outlets,omitempty"`
+}
+
+// OutletsFilter selects the outlets metrics are exported for. An outlet is exported if it is included, or no
+// include filters are set, and it is not excluded.
+type OutletsFilter struct {
+	IncludeIDs    []string `yaml:"include_ids,omitempty"`
+	ExcludeIDs    []string `yaml:"exclude_ids,omitempty"`
+	IncludeNames  *Regexp  `yaml:"include_names,omitempty"`
+	ExcludeNames  *Regexp  `yaml:"exclude_names,omitempty"`
+	ExcludeStates []string `yaml:"exclude_states,omitempty"`
+	// Exclude outlets that are off and have never consumed energy.
+	ExcludeUnused bool `yaml:"exclude_unused,omitempty"`
+}
+
+// Keep returns whether metrics should be exported for the outlet.
+func (f *OutletsFilter) Keep(id, name, state string, energy float64) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.IncludeIDs) > 0 || f.IncludeNames != nil {
+		if !contains(f.IncludeIDs, id) && (f.IncludeNames == nil || !f.IncludeNames.MatchString(name)) {
+			return false
+		}
+	}
+	if contains(f.ExcludeIDs, id) || f.ExcludeNames != nil && f.ExcludeNames.MatchString(name) {
+		return false
+	}
+	for _, s := range f.ExcludeStates {
+		if strings.EqualFold(s, state) {
+			return false
+		}
+	}
+	if f.ExcludeUnused && strings.EqualFold(state, "off") && energy == 0 {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Target configures a single PDU, or the PDUs matching a pattern.
+type Target struct {
+	// Name of the target, as passed in the 'target' parameter. Mutually exclusive with Pattern.
+	Name string `yaml:"name,omitempty"`
+	// Pattern matching the names of targets. Mutually exclusive with Name.
+	Pattern *Regexp `yaml:"pattern,omitempty"`
+	// Module used when one is not passed in the 'module' parameter.
+	Module string `yaml:"module,omitempty"`
+	// Credentials used when they are not passed in the 'user' and 'pass' parameters.
+	User     string `yaml:"user,omitempty"`
+	Password Secret `yaml:"password,omitempty"`
+	// File the password is read from. Mutually exclusive with Password.
+	PasswordFile string `yaml:"password_file,omitempty"`
+	// Labels added to every metric of the target.
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// Modbus unit ID the background polled readings of the target are served with, or 0 if not served.
+	ModbusUnitID int `yaml:"modbus_unit_id,omitempty"`
+}
+
+// Load parses the YAML configuration file at path.
+func Load(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file: %v", err)
+	}
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse config file %q: %v", path, err)
+	}
+	if err := cfg.expandEnv(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %v", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	for name, m := range c.Modules {
+		if m == nil {
+			m = &Module{}
+			c.Modules[name] = m
+		}
+		m.Name = name
+	}
+	modbusUnitIDs := make(map[int]bool)
+	names := make(map[string]bool)
+	for i, t := range c.Targets {
+		if _, ok := c.Modules[t.Module]; t.Module != "" && !ok {
+			return fmt.Errorf("target %d has unknown module %q", i+1, t.Module)
+		}
+		if (t.Name == "") == (t.Pattern == nil) {
+			return fmt.Errorf("target %d must have exactly one of name or pattern", i+1)
+		}
+		if t.Password != "" && t.PasswordFile != "" {
+			return fmt.Errorf("target %d must not have both password and password_file", i+1)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("target %d has duplicate name %q", i+1, t.Name)
+		}
+		if t.Name != "" {
+			names[t.Name] = true
+		}
+		for name := range t.Labels {
+			if !model.LegacyValidation.IsValidLabelName(name) || len(name) > 1 && name[:2] == "__" {
+				return fmt.Errorf("target %d has invalid label name %q", i+1, name)
+			}
+			if reservedLabels[name] {
+				return fmt.Errorf("target %d has label name %q, which is used by the exporter's metrics", i+1, name)
+			}
+		}
+		if t.ModbusUnitID != 0 {
+			if t.Name == "" {
+				return fmt.Errorf("target %d has a modbus_unit_id but no name", i+1)
+			}
+			if t.ModbusUnitID < 1 || t.ModbusUnitID > 247 {
+				return fmt.Errorf("target %d has modbus_unit_id %d, must be between 1 and 247", i+1, t.ModbusUnitID)
+			}
+			if modbusUnitIDs[t.ModbusUnitID] {
+				return fmt.Errorf("target %d has duplicate modbus_unit_id %d", i+1, t.ModbusUnitID)
+			}
+			modbusUnitIDs[t.ModbusUnitID] = true
+		}
+	}
+	return nil
+}
+
+// Match returns the first target configuration with the name of, or a pattern matching, target. Nil is returned
+// if no target configuration matches.
+func (c *Config) Match(target string) *Target {
+	if c == nil {
+		return nil
+	}
+	for _, t := range c.Targets {
+		if t.Name == target || t.Pattern != nil && t.Pattern.MatchString(target) {
+			return t
+		}
+	}
+	return nil
+}
+
+// Module returns the module with name, or the module configured for target if name is empty. The default module is
+// used if neither name nor the target's module is set. A nil module with no error is returned if the default module
+// is not configured.
+func (c *Config) Module(name, target string) (*Module, error) {
+	if name == "" {
+		if t := c.Match(target); t != nil && t.Module != "" {
+			name = t.Module
+		}
+	}
+	if name == "" {
+		name = DefaultModule
+		if c == nil || c.Modules[name] == nil {
+			return nil, nil
+		}
+	}
+	if c == nil || c.Modules[name] == nil {
+		return nil, fmt.Errorf("unknown module %q", name)
+	}
+	return c.Modules[name], nil
+}
+
+// Regexp is a regular expression that is anchored to match the whole string.
+type Regexp struct {
+	*regexp.Regexp
+	original string
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	r, err := regexp.Compile("^(?:" + s + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", s, err)
+	}
+	re.Regexp, re.original = r, s
+	return nil
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (re Regexp) MarshalYAML() (interface{}, error) {
+	return re.original, nil
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func parse(t *testing.T, content string) *Config {
+	t.Helper()
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict([]byte(content), cfg); err != nil {
+		t.Fatalf("cannot parse config: %v", err)
+	}
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	ReserveLabels("id", "collector")
+
+	for _, test := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name: "valid",
+			config: `
+modules:
+  web:
+targets:
+  - name: pdu1
+    module: web
+    labels: {site: dc1}
+    modbus_unit_id: 1
+  - pattern: pdu.*
+    password_file: /etc/pass`,
+		},
+		{
+			name:   "unknown module",
+			config: `targets: [{name: pdu1, module: web}]`,
+			err:    `target 1 has unknown module "web"`,
+		},
+		{
+			name:   "no name or pattern",
+			config: `targets: [{user: admn}]`,
+			err:    "target 1 must have exactly one of name or pattern",
+		},
+		{
+			name:   "name and pattern",
+			config: `targets: [{name: pdu1, pattern: pdu.*}]`,
+			err:    "target 1 must have exactly one of name or pattern",
+		},
+		{
+			name:   "password and password file",
+			config: `targets: [{name: pdu1, password: admn, password_file: /etc/pass}]`,
+			err:    "target 1 must not have both password and password_file",
+		},
+		{
+			name:   "duplicate name",
+			config: `targets: [{name: pdu1}, {name: pdu1}]`,
+			err:    `target 2 has duplicate name "pdu1"`,
+		},
+		{
+			name:   "invalid label name",
+			config: `targets: [{name: pdu1, labels: {1site: dc1}}]`,
+			err:    `target 1 has invalid label name "1site"`,
+		},
+		{
+			name:   "reserved label name prefix",
+			config: `targets: [{name: pdu1, labels: {__site: dc1}}]`,
+			err:    `target 1 has invalid label name "__site"`,
+		},
+		{
+			name:   "exporter label name",
+			config: `targets: [{name: pdu1, labels: {collector: dc1}}]`,
+			err:    `target 1 has label name "collector", which is used by the exporter's metrics`,
+		},
+		{
+			name:   "modbus unit ID without name",
+			config: `targets: [{pattern: pdu.*, modbus_unit_id: 1}]`,
+			err:    "target 1 has a modbus_unit_id but no name",
+		},
+		{
+			name:   "modbus unit ID out of range",
+			config: `targets: [{name: pdu1, modbus_unit_id: 248}]`,
+			err:    "target 1 has modbus_unit_id 248, must be between 1 and 247",
+		},
+		{
+			name:   "duplicate modbus unit ID",
+			config: `targets: [{name: pdu1, modbus_unit_id: 1}, {name: pdu2, modbus_unit_id: 1}]`,
+			err:    "target 2 has duplicate modbus_unit_id 1",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := parse(t, test.config).validate()
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case test.err != "" && err == nil:
+				t.Errorf("expected error %q", test.err)
+			case test.err != "" && !strings.Contains(err.Error(), test.err):
+				t.Errorf("expected error %q, got %q", test.err, err)
+			}
+		})
+	}
+}
+
+func TestValidateModuleNames(t *testing.T) {
+	cfg := parse(t, "modules:\n  web:\n  api: {outlets: {exclude_unused: true}}")
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, m := range cfg.Modules {
+		if m == nil || m.Name != name {
+			t.Errorf("module %q has name %v", name, m)
+		}
+	}
+}
+
+func TestOutletsFilterKeep(t *testing.T) {
+	type outlet struct {
+		id, name, state string
+		energy          float64
+	}
+	a1 := outlet{"AA1", "web1", "On", 12.5}
+	a2 := outlet{"AA2", "db1", "On", 3}
+	a3 := outlet{"AA3", "spare", "Off", 0}
+	a4 := outlet{"AA4", "old", "Off", 1.2}
+
+	for _, test := range []struct {
+		name    string
+		filter  string
+		kept    []outlet
+		dropped []outlet
+	}{
+		{
+			name: "no filters",
+			kept: []outlet{a1, a2, a3, a4},
+		},
+		{
+			name:    "include IDs",
+			filter:  "include_ids: [AA1, AA3]",
+			kept:    []outlet{a1, a3},
+			dropped: []outlet{a2, a4},
+		},
+		{
+			name:    "include names anchored",
+			filter:  "include_names: web|db",
+			dropped: []outlet{a1, a2, a3, a4},
+		},
+		{
+			name:    "include IDs or names",
+			filter:  "{include_ids: [AA3], include_names: 'web.*'}",
+			kept:    []outlet{a1, a3},
+			dropped: []outlet{a2, a4},
+		},
+		{
+			name:    "exclude IDs and names",
+			filter:  "{exclude_ids: [AA1], exclude_names: 'db.*'}",
+			kept:    []outlet{a3, a4},
+			dropped: []outlet{a1, a2},
+		},
+		{
+			name:    "exclude takes precedence over include",
+			filter:  "{include_ids: [AA1, AA2], exclude_names: 'web.*'}",
+			kept:    []outlet{a2},
+			dropped: []outlet{a1, a3, a4},
+		},
+		{
+			name:    "exclude states case insensitive",
+			filter:  "exclude_states: [off]",
+			kept:    []outlet{a1, a2},
+			dropped: []outlet{a3, a4},
+		},
+		{
+			name:    "exclude unused",
+			filter:  "exclude_unused: true",
+			kept:    []outlet{a1, a2, a4},
+			dropped: []outlet{a3},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			filter := &OutletsFilter{}
+			if err := yaml.UnmarshalStrict([]byte(test.filter), filter); err != nil {
+				t.Fatalf("cannot parse filter: %v", err)
+			}
+			for _, o := range test.kept {
+				if !filter.Keep(o.id, o.name, o.state, o.energy) {
+					t.Errorf("outlet %s (%s) not kept", o.id, o.name)
+				}
+			}
+			for _, o := range test.dropped {
+				if filter.Keep(o.id, o.name, o.state, o.energy) {
+					t.Errorf("outlet %s (%s) kept", o.id, o.name)
+				}
+			}
+		})
+	}
+}
+
+func TestOutletsFilterKeepNil(t *testing.T) {
+	var filter *OutletsFilter
+	if !filter.Keep("AA1", "web1", "Off", 0) {
+		t.Error("outlet not kept by nil filter")
+	}
+}
@@ -0,0 +1,165 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "<secret>"
+
+var (
+	// envRegex matches ${VAR} references to environment variables. $VAR is not expanded, so that passwords may
+	// contain '$'.
+	envRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+	// secretKeyRegex matches characters that are not allowed in the names of secrets directory files, which are those
+	// allowed in Kubernetes secret keys.
+	secretKeyRegex = regexp.MustCompile(`[^-._A-Za-z0-9]`)
+
+	secrets = &secretFiles{files: make(map[string]secretFile)}
+)
+
+// Secret is a string that is redacted when marshalled, formatted or logged.
+type Secret string
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (s Secret) MarshalYAML() (interface{}, error) {
+	if s == "" {
+		return "", nil
+	}
+	return redacted, nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if s == "" {
+		return json.Marshal("")
+	}
+	return json.Marshal(redacted)
+}
+
+// String implements the fmt.Stringer interface.
+func (s Secret) String() string {
+	return redacted
+}
+
+// LogValue implements the slog.LogValuer interface.
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+// Credentials returns the credentials of target. Credentials are taken from the first target configuration matching
+// target, with the password read from its password_file if set. A user or password that is not configured is read
+// from the <target>.user or <target>.password file of the secrets directory, where characters of target not allowed
+// in Kubernetes secret keys are replaced with '_', or else from its user or password file. Files are re-read when
+// they change. No credentials are returned for targets no configuration matches, so that requests for arbitrary
+// targets are not sent the credentials of the secrets directory.
+func (c *Config) Credentials(target string) (string, string, error) {
+	if c == nil {
+		return "", "", nil
+	}
+	t := c.Match(target)
+	if t == nil {
+		return "", "", nil
+	}
+	user, pass := t.User, string(t.Password)
+	if t.PasswordFile != "" {
+		var err error
+		if pass, _, err = secrets.read(t.PasswordFile, true); err != nil {
+			return "", "", err
+		}
+	}
+	if c.SecretsDir == "" {
+		return user, pass, nil
+	}
+
+	key := secretKeyRegex.ReplaceAllString(target, "_")
+	for _, s := range []struct {
+		value *string
+		name  string
+	}{{&user, "user"}, {&pass, "password"}} {
+		if *s.value != "" {
+			continue
+		}
+		for _, file := range []string{key + "." + s.name, s.name} {
+			v, ok, err := secrets.read(filepath.Join(c.SecretsDir, file), false)
+			if err != nil {
+				return "", "", err
+			}
+			if ok {
+				*s.value = v
+				break
+			}
+		}
+	}
+	return user, pass, nil
+}
+
+// expandEnv expands ${VAR} references to environment variables in the credentials of the configuration. It fails
+// if a variable is not set.
+func (c *Config) expandEnv() error {
+	fields := []*string{&c.SecretsDir}
+	for _, t := range c.Targets {
+		fields = append(fields, &t.User, (*string)(&t.Password), &t.PasswordFile)
+	}
+	for _, f := range fields {
+		var err error
+		*f = envRegex.ReplaceAllStringFunc(*f, func(ref string) string {
+			name := envRegex.FindStringSubmatch(ref)[1]
+			v, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %q is not set", name)
+			}
+			return v
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type secretFile struct {
+	modTime time.Time
+	size    int64
+	content string
+}
+
+// secretFiles caches the contents of secret files, re-reading them when their modification time or size changes.
+type secretFiles struct {
+	mu    sync.Mutex
+	files map[string]secretFile
+}
+
+// read returns the contents of the secret file at path, without trailing newlines, and whether it exists. It fails
+// if the file does not exist and is required.
+func (s *secretFiles) read(path string, required bool) (string, bool, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) && !required {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("cannot read secret file: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.files[path]; ok && f.modTime.Equal(info.ModTime()) && f.size == info.Size() {
+		return f.content, true, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("cannot read secret file: %v", err)
+	}
+	f := secretFile{modTime: info.ModTime(), size: info.Size(), content: strings.TrimRight(string(content), "\r\n")}
+	s.files[path] = f
+	return f.content, true, nil
+}
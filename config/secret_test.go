@@ -0,0 +1,152 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("PDU_USER", "admn")
+	t.Setenv("PDU_PASS", "pa$$")
+
+	for _, test := range []struct {
+		name     string
+		config   string
+		user     string
+		password Secret
+		err      string
+	}{
+		{
+			name:     "expanded",
+			config:   `targets: [{name: pdu1, user: '${PDU_USER}', password: 'x${PDU_PASS}x'}]`,
+			user:     "admn",
+			password: "xpa$$x",
+		},
+		{
+			name:     "dollar without braces not expanded",
+			config:   `targets: [{name: pdu1, user: $PDU_USER, password: pa$$}]`,
+			user:     "$PDU_USER",
+			password: "pa$$",
+		},
+		{
+			name:   "not set",
+			config: `targets: [{name: pdu1, password: '${PDU_UNSET}'}]`,
+			err:    `environment variable "PDU_UNSET" is not set`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := parse(t, test.config)
+			err := cfg.expandEnv()
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if target := cfg.Targets[0]; target.User != test.user || target.Password != test.password {
+				t.Errorf("expected %q, %q, got %q, %q", test.user, test.password, target.User, string(target.Password))
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "pdu1.password"), "pass1\n")
+	writeFile(t, filepath.Join(dir, "pdu_2.example.user"), "user2")
+	writeFile(t, filepath.Join(dir, "user"), "admn")
+	writeFile(t, filepath.Join(dir, "password"), "admn")
+	passwordFile := filepath.Join(dir, "pdu3")
+	writeFile(t, passwordFile, "pass3\r\n")
+
+	cfg := parse(t, `
+targets:
+  - name: pdu1
+  - pattern: pdu:.*
+  - name: pdu3
+    password_file: `+passwordFile+`
+  - name: pdu4
+    user: user4
+  - name: pdu5
+    password_file: `+filepath.Join(dir, "missing"))
+	cfg.SecretsDir = dir
+
+	for _, test := range []struct {
+		target, user, pass, err string
+	}{
+		{target: "pdu1", user: "admn", pass: "pass1"},
+		{target: "pdu:2.example", user: "user2", pass: "admn"},
+		{target: "pdu3", user: "admn", pass: "pass3"},
+		{target: "pdu4", user: "user4", pass: "admn"},
+		{target: "pdu5", err: "cannot read secret file"},
+		// Targets no configuration matches are not given the credentials of the secrets directory.
+		{target: "pdu6"},
+		{target: "attacker.example:443"},
+	} {
+		t.Run(test.target, func(t *testing.T) {
+			user, pass, err := cfg.Credentials(test.target)
+			if test.err != "" {
+				if err == nil {
+					t.Fatalf("expected error %q", test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if user != test.user || pass != test.pass {
+				t.Errorf("expected %q, %q, got %q, %q", test.user, test.pass, user, pass)
+			}
+		})
+	}
+}
+
+func TestSecretFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	files := &secretFiles{files: make(map[string]secretFile)}
+
+	for i, test := range []struct {
+		content, expected string
+		modTime           time.Time
+	}{
+		{content: "pass1\n", expected: "pass1", modTime: time.Unix(1000, 0)},
+		// The cached content is returned while the modification time and size are unchanged.
+		{content: "pass2\n", expected: "pass1", modTime: time.Unix(1000, 0)},
+		{content: "pass2\n", expected: "pass2", modTime: time.Unix(2000, 0)},
+		{content: "pass23\n", expected: "pass23", modTime: time.Unix(2000, 0)},
+	} {
+		writeFile(t, path, test.content)
+		if err := os.Chtimes(path, test.modTime, test.modTime); err != nil {
+			t.Fatal(err)
+		}
+		content, ok, err := files.read(path, true)
+		if err != nil || !ok {
+			t.Fatalf("%d: cannot read secret file: %v", i, err)
+		}
+		if content != test.expected {
+			t.Errorf("%d: expected %q, got %q", i, test.expected, content)
+		}
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := files.read(path, false); ok || err != nil {
+		t.Errorf("expected removed file not to exist, got %v, %v", ok, err)
+	}
+	if _, _, err := files.read(path, true); err == nil {
+		t.Error("expected error reading removed required file")
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/tynany/servertech_exporter/collector"
+)
+
+const controlPath = "/api/v1/outlets/"
+
+var (
+	controlEnabled    = kingpin.Flag("control.enabled", "Enable the outlet power control API.").Default("False").Bool()
+	controlTokensFile = kingpin.Flag("control.tokens-file", "Path to a file of 'name:token' lines, one per line, of bearer tokens allowed to use the outlet power control API.").String()
+	controlClientCA   = kingpin.Flag("control.client-ca", "Path to a CA certificate bundle. Clients presenting a certificate signed by this CA are allowed to use the outlet power control API.").String()
+	controlDryRun     = kingpin.Flag("control.dry-run", "Authorize and audit outlet power control requests without sending them to the device.").Default("False").Bool()
+	controlAuditLog   = kingpin.Flag("control.audit-log", "Path to the file outlet power control requests are audited to. Audit records are logged if not specified.").String()
+)
+
+// controlTokens maps a bearer token to the name it identifies.
+type controlTokens map[string]string
+
+func loadControlTokens(path string) (controlTokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open control tokens file: %v", err)
+	}
+	defer f.Close()
+
+	tokens := make(controlTokens)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("control tokens file line %d is not in 'name:token' format", lineNum)
+		}
+		tokens[parts[1]] = parts[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read control tokens file: %v", err)
+	}
+	return tokens, nil
+}
+
+// lookup returns the name identified by token, comparing tokens in constant time.
+func (t controlTokens) lookup(token string) (string, bool) {
+	name, found := "", false
+	for candidate, candidateName := range t {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			name, found = candidateName, true
+		}
+	}
+	return name, found
+}
+
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Identity   string    `json:"identity"`
+	RemoteAddr string    `json:"remote_addr"`
+	Target     string    `json:"target"`
+	OutletID   string    `json:"outlet_id"`
+	Action     string    `json:"action"`
+	DryRun     bool      `json:"dry_run"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type auditLogger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newAuditLogger(path string) (*auditLogger, error) {
+	if path == "" {
+		return &auditLogger{}, nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open control audit log: %v", err)
+	}
+	return &auditLogger{file: f}, nil
+}
+
+func (a *auditLogger) log(rec auditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("cannot marshal control audit record", "err", err)
+		return
+	}
+	if a.file == nil {
+		slog.Info("control audit", "record", string(line))
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		slog.Error("cannot write control audit record", "err", err)
+	}
+}
+
+type controlHandler struct {
+	tokens    controlTokens
+	clientCAs *x509.CertPool
+	audit     *auditLogger
+}
+
+func newControlHandler() (*controlHandler, error) {
+	if *controlTokensFile == "" && *controlClientCA == "" {
+		return nil, fmt.Errorf("outlet power control enabled but neither --control.tokens-file nor --control.client-ca specified")
+	}
+	if *controlClientCA != "" && *httpOnly {
+		return nil, fmt.Errorf("--control.client-ca requires HTTPS mode")
+	}
+	h := &controlHandler{}
+	if *controlTokensFile != "" {
+		tokens, err := loadControlTokens(*controlTokensFile)
+		if err != nil {
+			return nil, err
+		}
+		h.tokens = tokens
+	}
+	if *controlClientCA != "" {
+		pool, err := loadCertPool(*controlClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load control client CA: %v", err)
+		}
+		h.clientCAs = pool
+	}
+	audit, err := newAuditLogger(*controlAuditLog)
+	if err != nil {
+		return nil, err
+	}
+	h.audit = audit
+	return h, nil
+}
+
+// identify returns the identity of the client making the request, if authorized.
+func (h *controlHandler) identify(r *http.Request) (string, bool) {
+	if auth := r.Header.Get("Authorization"); h.tokens != nil && strings.HasPrefix(auth, "Bearer ") {
+		if name, ok := h.tokens.lookup(strings.TrimPrefix(auth, "Bearer ")); ok {
+			return "token:" + name, true
+		}
+		return "", false
+	}
+	if r.TLS != nil && h.clientCAs != nil && len(r.TLS.PeerCertificates) > 0 {
+		// Verified against the control client CA rather than trusting the TLS handshake, which also accepts
+		// certificates signed by the web configuration file's client_ca_file.
+		cert := r.TLS.PeerCertificates[0]
+		intermediates := x509.NewCertPool()
+		for _, c := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+		opts := x509.VerifyOptions{Roots: h.clientCAs, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+		if _, err := cert.Verify(opts); err == nil {
+			return "cert:" + cert.Subject.CommonName, true
+		}
+	}
+	return "", false
+}
+
+func (h *controlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, controlPath), "/")
+	rec := auditRecord{
+		Time:       time.Now(),
+		RemoteAddr: r.RemoteAddr,
+		DryRun:     *controlDryRun,
+	}
+	if len(parts) == 3 {
+		rec.Target, rec.OutletID, rec.Action = parts[0], parts[1], strings.ToLower(parts[2])
+	}
+
+	identity, ok := h.identify(r)
+	if !ok {
+		rec.Result = "unauthorized"
+		h.audit.log(rec)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rec.Identity = identity
+
+	// Every authorized request is audited, including those rejected as invalid.
+	reject := func(status int, msg string) {
+		rec.Result = "rejected"
+		rec.Error = msg
+		h.audit.log(rec)
+		http.Error(w, msg, status)
+	}
+	if len(parts) != 3 || rec.Target == "" {
+		reject(http.StatusNotFound, "path must be in the form "+controlPath+"{target}/{outlet_id}/{action}")
+		return
+	}
+	if !collector.ValidOutletID(rec.OutletID) {
+		reject(http.StatusBadRequest, fmt.Sprintf("invalid outlet ID %q", rec.OutletID))
+		return
+	}
+	if !collector.ValidOutletAction(rec.Action) {
+		reject(http.StatusBadRequest, fmt.Sprintf("action must be one of: %s", strings.Join(collector.OutletActions, ", ")))
+		return
+	}
+	if dryRun := r.FormValue("dry_run"); dryRun != "" {
+		v, err := strconv.ParseBool(dryRun)
+		if err != nil {
+			reject(http.StatusBadRequest, "'dry_run' parameter must be a boolean")
+			return
+		}
+		rec.DryRun = rec.DryRun || v
+	}
+	t, err := resolveNamedTarget(r, rec.Target)
+	if err != nil {
+		reject(http.StatusBadRequest, err.Error())
+		return
+	}
+	if t.user == "" && t.pass == "" {
+		reject(http.StatusBadRequest, fmt.Sprintf("no credentials configured for target %q", rec.Target))
+		return
+	}
+
+	status := http.StatusOK
+	rec.Result = "dry run"
+	if !rec.DryRun {
+		// SetOutletControl fails unless the PDU responds to the control request with a 2xx status.
+		rec.Result = "success"
+		if err := collector.SetOutletControl(t.target, t.user, t.pass, rec.OutletID, rec.Action); err != nil {
+			rec.Result = "failure"
+			rec.Error = err.Error()
+			status = http.StatusBadGateway
+		}
+	}
+	h.audit.log(rec)
+
+	writeJSON(w, status, rec)
+}
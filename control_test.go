@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tynany/servertech_exporter/config"
+)
+
+// useConfig makes content the active configuration file for the duration of the test.
+func useConfig(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "servertech.yml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := activeConfig.Swap(cfg)
+	t.Cleanup(func() { activeConfig.Store(previous) })
+}
+
+func TestControlTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte("# comment\nalice:s3cret\n\nbob:token:with:colons\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := loadControlTokens(path)
+	if err != nil {
+		t.Fatalf("cannot load tokens: %v", err)
+	}
+	for _, test := range []struct {
+		token, name string
+		found       bool
+	}{
+		{"s3cret", "alice", true},
+		{"token:with:colons", "bob", true},
+		{"s3cre", "", false},
+		{"alice", "", false},
+		{"", "", false},
+	} {
+		if name, found := tokens.lookup(test.token); name != test.name || found != test.found {
+			t.Errorf("lookup(%q): expected %q, %v, got %q, %v", test.token, test.name, test.found, name, found)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("alice:s3cret\nbob\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadControlTokens(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected error on line 2, got %v", err)
+	}
+}
+
+// newCert returns a certificate with commonName, signed by parent and parentKey, or self-signed if parent is nil.
+func newCert(t *testing.T, commonName string, isCA bool, usage x509.ExtKeyUsage, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestControlIdentify(t *testing.T) {
+	ca, caKey := newCert(t, "control-ca", true, x509.ExtKeyUsageClientAuth, nil, nil)
+	otherCA, otherCAKey := newCert(t, "web-ca", true, x509.ExtKeyUsageClientAuth, nil, nil)
+	client, _ := newCert(t, "ops-automation", false, x509.ExtKeyUsageClientAuth, ca, caKey)
+	server, _ := newCert(t, "not-a-client", false, x509.ExtKeyUsageServerAuth, ca, caKey)
+	other, _ := newCert(t, "web-client", false, x509.ExtKeyUsageClientAuth, otherCA, otherCAKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	h := &controlHandler{tokens: controlTokens{"s3cret": "alice"}, clientCAs: pool}
+
+	for _, test := range []struct {
+		name     string
+		auth     string
+		certs    []*x509.Certificate
+		identity string
+		ok       bool
+	}{
+		{name: "token", auth: "Bearer s3cret", identity: "token:alice", ok: true},
+		{name: "unknown token", auth: "Bearer wrong"},
+		{name: "unknown token with certificate", auth: "Bearer wrong", certs: []*x509.Certificate{client}},
+		{name: "basic authentication", auth: "Basic YWRtbjphZG1u"},
+		{name: "certificate", certs: []*x509.Certificate{client}, identity: "cert:ops-automation", ok: true},
+		{name: "certificate of another CA", certs: []*x509.Certificate{other}},
+		{name: "certificate not for client authentication", certs: []*x509.Certificate{server}},
+		{name: "no credentials"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, controlPath+"pdu1/AA1/on", nil)
+			if test.auth != "" {
+				r.Header.Set("Authorization", test.auth)
+			}
+			if test.certs != nil {
+				r.TLS = &tls.ConnectionState{PeerCertificates: test.certs}
+			}
+			if identity, ok := h.identify(r); identity != test.identity || ok != test.ok {
+				t.Errorf("expected %q, %v, got %q, %v", test.identity, test.ok, identity, ok)
+			}
+		})
+	}
+}
+
+// jawsRequest is a request received by the fake JAWS control API.
+type jawsRequest struct {
+	method, path, user, pass, body string
+}
+
+func TestControlHandler(t *testing.T) {
+	var received []jawsRequest
+	jawsStatus := http.StatusNoContent
+	jaws := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			return
+		}
+		user, pass, _ := r.BasicAuth()
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, jawsRequest{r.Method, r.URL.Path, user, pass, string(body)})
+		if r.URL.Path == "/jaws/control/outlets/AA9" {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		w.WriteHeader(jawsStatus)
+	}))
+	defer jaws.Close()
+	target := jaws.Listener.Addr().String()
+	useConfig(t, "targets:\n  - name: "+target+"\n    user: admn\n    password: s3cret\n")
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := newAuditLogger(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &controlHandler{tokens: controlTokens{"token": "alice"}, audit: audit}
+
+	for _, test := range []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		jawsStatus int
+		status     int
+		// Expected audit record, without its time and remote address, or nil if the request is not audited.
+		audit *auditRecord
+		// Expected request to JAWS, if sent.
+		jaws *jawsRequest
+	}{
+		{
+			name:   "method not allowed",
+			method: http.MethodGet,
+			path:   target + "/AA1/off",
+			token:  "token",
+			status: http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "unauthorized",
+			path:   target + "/AA1/off",
+			token:  "wrong",
+			status: http.StatusUnauthorized,
+			audit:  &auditRecord{Target: target, OutletID: "AA1", Action: "off", Result: "unauthorized"},
+		},
+		{
+			name:   "invalid path",
+			path:   target + "/AA1",
+			token:  "token",
+			status: http.StatusNotFound,
+			audit: &auditRecord{Identity: "token:alice", Result: "rejected",
+				Error: "path must be in the form /api/v1/outlets/{target}/{outlet_id}/{action}"},
+		},
+		{
+			name:   "invalid outlet",
+			path:   target + "/A-1/off",
+			token:  "token",
+			status: http.StatusBadRequest,
+			audit: &auditRecord{Identity: "token:alice", Target: target, OutletID: "A-1", Action: "off", Result: "rejected",
+				Error: `invalid outlet ID "A-1"`},
+		},
+		{
+			name:   "invalid action",
+			path:   target + "/AA1/explode",
+			token:  "token",
+			status: http.StatusBadRequest,
+			audit: &auditRecord{Identity: "token:alice", Target: target, OutletID: "AA1", Action: "explode", Result: "rejected",
+				Error: "action must be one of: on, off, reboot"},
+		},
+		{
+			name:   "invalid dry run",
+			path:   target + "/AA1/off?dry_run=maybe",
+			token:  "token",
+			status: http.StatusBadRequest,
+			audit: &auditRecord{Identity: "token:alice", Target: target, OutletID: "AA1", Action: "off", Result: "rejected",
+				Error: "'dry_run' parameter must be a boolean"},
+		},
+		{
+			name:   "target without credentials",
+			path:   "192.0.2.1/AA1/off",
+			token:  "token",
+			status: http.StatusBadRequest,
+			audit: &auditRecord{Identity: "token:alice", Target: "192.0.2.1", OutletID: "AA1", Action: "off", Result: "rejected",
+				Error: `no credentials configured for target "192.0.2.1"`},
+		},
+		{
+			name:   "dry run",
+			path:   target + "/AA1/off?dry_run=true",
+			token:  "token",
+			status: http.StatusOK,
+			audit:  &auditRecord{Identity: "token:alice", Target: target, OutletID: "AA1", Action: "off", DryRun: true, Result: "dry run"},
+		},
+		{
+			name:   "success",
+			path:   target + "/AA1/Reboot",
+			token:  "token",
+			status: http.StatusOK,
+			audit:  &auditRecord{Identity: "token:alice", Target: target, OutletID: "AA1", Action: "reboot", Result: "success"},
+			jaws:   &jawsRequest{http.MethodPatch, "/jaws/control/outlets/AA1", "admn", "s3cret", `{"control_action":"reboot"}`},
+		},
+		{
+			name:       "rejected by the PDU",
+			path:       target + "/AA2/on",
+			token:      "token",
+			jawsStatus: http.StatusUnauthorized,
+			status:     http.StatusBadGateway,
+			audit: &auditRecord{Identity: "token:alice", Target: target, OutletID: "AA2", Action: "on", Result: "failure",
+				Error: "incorrect status code received from device: 401"},
+			jaws: &jawsRequest{http.MethodPatch, "/jaws/control/outlets/AA2", "admn", "s3cret", `{"control_action":"on"}`},
+		},
+		{
+			name:   "redirected by the PDU",
+			path:   target + "/AA9/on",
+			token:  "token",
+			status: http.StatusBadGateway,
+			audit: &auditRecord{Identity: "token:alice", Target: target, OutletID: "AA9", Action: "on", Result: "failure",
+				Error: "control request redirected to GET /login"},
+			jaws: &jawsRequest{http.MethodPatch, "/jaws/control/outlets/AA9", "admn", "s3cret", `{"control_action":"on"}`},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			received = nil
+			jawsStatus = http.StatusNoContent
+			if test.jawsStatus != 0 {
+				jawsStatus = test.jawsStatus
+			}
+			if err := os.Truncate(auditPath, 0); err != nil {
+				t.Fatal(err)
+			}
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			r := httptest.NewRequest(method, controlPath+test.path, nil)
+			r.Header.Set("Authorization", "Bearer "+test.token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("expected status %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			content, err := os.ReadFile(auditPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case test.audit == nil && len(content) > 0:
+				t.Errorf("expected no audit record, got %s", content)
+			case test.audit != nil:
+				var rec auditRecord
+				if err := json.Unmarshal(content, &rec); err != nil {
+					t.Fatalf("cannot parse audit record %q: %v", content, err)
+				}
+				if rec.Time.IsZero() || rec.RemoteAddr == "" {
+					t.Errorf("expected audit record with time and remote address, got %+v", rec)
+				}
+				rec.Time, rec.RemoteAddr = time.Time{}, ""
+				if rec != *test.audit {
+					t.Errorf("expected audit record %+v, got %+v", *test.audit, rec)
+				}
+			}
+			switch {
+			case test.jaws == nil && len(received) > 0:
+				t.Errorf("expected no request to the PDU, got %+v", received)
+			case test.jaws != nil && (len(received) != 1 || received[0] != *test.jaws):
+				t.Errorf("expected request to the PDU %+v, got %+v", *test.jaws, received)
+			}
+		})
+	}
+}
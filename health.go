@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/tynany/servertech_exporter/poll"
+)
+
+const (
+	healthyPath = "/-/healthy"
+	readyPath   = "/-/ready"
+)
+
+var (
+	shutdownTimeout     = kingpin.Flag("web.shutdown-timeout", "Time to wait on SIGTERM for scrapes in progress to finish before exiting.").Default("30s").Duration()
+	pollShutdownTimeout = kingpin.Flag("poll.shutdown-timeout", "Time to wait on SIGTERM for the background poll in progress to finish and the outputs to be flushed before exiting.").Default("30s").Duration()
+
+	shuttingDown atomic.Bool
+)
+
+// healthyHandler returns 200 while the exporter is running.
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("Healthy\n"))
+}
+
+// readyHandler returns 200 once the configuration file is loaded and, if background polling is enabled, the first
+// poll has been written, and 503 otherwise or while shutting down.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case shuttingDown.Load():
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	case *configFile != "" && activeConfig.Load() == nil:
+		http.Error(w, "config not loaded", http.StatusServiceUnavailable)
+	case poll.Enabled() && !poll.Polled():
+		http.Error(w, "waiting for first poll", http.StatusServiceUnavailable)
+	default:
+		w.Write([]byte("Ready\n"))
+	}
+}
+
+// shutdownOnSignal shuts down server on SIGTERM or SIGINT, no longer accepting connections and waiting for requests
+// in progress to finish until the shutdown timeout. Background polling is stopped at the same time with stopPolling,
+// if not nil, which is given until the poll shutdown timeout.
+func shutdownOnSignal(server *http.Server, stopPolling func(ctx context.Context)) {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	sig := <-term
+	slog.Info("shutting down", "signal", sig.String(), "timeout", *shutdownTimeout, "poll_timeout", *pollShutdownTimeout)
+	shuttingDown.Store(true)
+
+	var wg sync.WaitGroup
+	if stopPolling != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), *pollShutdownTimeout)
+			defer cancel()
+			stopPolling(ctx)
+		}()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("requests in progress did not finish", "err", err)
+	}
+	wg.Wait()
+	slog.Info("shut down")
+}
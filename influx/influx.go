@@ -0,0 +1,263 @@
+// Package influx encodes metrics as InfluxDB line protocol, and writes background polled metrics to the InfluxDB v2
+// write API.
+package influx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tynany/servertech_exporter/collector"
+	"github.com/tynany/servertech_exporter/poll"
+)
+
+const (
+	namespace = "servertech"
+
+	// ContentType is the content type of line protocol.
+	ContentType = "text/plain; charset=utf-8"
+)
+
+var (
+	url       = kingpin.Flag("influx.url", "URL of the InfluxDB v2 server background polled metrics are written to, e.g. http://influxdb:8086.").String()
+	org       = kingpin.Flag("influx.org", "InfluxDB organization background polled metrics are written to.").String()
+	bucket    = kingpin.Flag("influx.bucket", "InfluxDB bucket background polled metrics are written to.").String()
+	tokenFile = kingpin.Flag("influx.token-file", "Path to a file containing the InfluxDB API token.").String()
+	timeout   = kingpin.Flag("influx.timeout", "Timeout of requests to InfluxDB.").Default("30s").Duration()
+
+	writeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "servertech_influx_write_failures_total",
+		Help: "Total number of failed writes of background polled metrics to InfluxDB.",
+	})
+	linesWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "servertech_influx_lines_written_total",
+		Help: "Total number of lines successfully written to InfluxDB.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(writeFailures, linesWritten)
+}
+
+// line is a single line of line protocol: the fields of a measurement with a tag set.
+type line struct {
+	measurement string
+	tags        []*dto.LabelPair
+	fields      map[string]float64
+}
+
+// Encode writes families to w as line protocol timestamped with ts, and returns the number of lines written.
+// Metrics are written to a measurement named after their subsystem (outlets, cords, ...), or "servertech" for
+// metrics of the exporter itself, with their labels as tags and the remainder of their name as the field. Metrics
+// of a subsystem with the same labels are written as fields of a single line. Empty labels are not written as tags,
+// and values that are not finite are not written, as line protocol cannot represent them.
+func Encode(w io.Writer, families []*dto.MetricFamily, ts time.Time) (int, error) {
+	subsystems := collector.Subsystems()
+	lines := make(map[string]*line)
+	var keys []string
+	add := func(name string, m *dto.Metric, value float64) {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return
+		}
+		measurement, field := namespace, strings.TrimPrefix(name, namespace+"_")
+		for _, s := range subsystems {
+			if strings.HasPrefix(field, s+"_") {
+				measurement, field = s, strings.TrimPrefix(field, s+"_")
+				break
+			}
+		}
+		var tags []*dto.LabelPair
+		for _, l := range m.GetLabel() {
+			if l.GetValue() != "" {
+				tags = append(tags, l)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i].GetName() < tags[j].GetName() })
+
+		key := seriesKey(measurement, tags)
+		l, ok := lines[key]
+		if !ok {
+			l = &line{measurement: measurement, tags: tags, fields: make(map[string]float64)}
+			lines[key] = l
+			keys = append(keys, key)
+		}
+		l.fields[field] = value
+	}
+
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				add(name+"_sum", m, m.GetSummary().GetSampleSum())
+				add(name+"_count", m, float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				add(name+"_sum", m, m.GetHistogram().GetSampleSum())
+				add(name+"_count", m, float64(m.GetHistogram().GetSampleCount()))
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		l := lines[key]
+		buf.WriteString(escape(l.measurement, ", "))
+		for _, t := range l.tags {
+			buf.WriteString("," + escape(t.GetName(), ",= ") + "=" + escape(t.GetValue(), ",= "))
+		}
+		fields := make([]string, 0, len(l.fields))
+		for f := range l.fields {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		for i, f := range fields {
+			sep := ","
+			if i == 0 {
+				sep = " "
+			}
+			buf.WriteString(sep + escape(f, ",= ") + "=" + strconv.FormatFloat(l.fields[f], 'g', -1, 64))
+		}
+		buf.WriteString(" " + strconv.FormatInt(ts.UnixNano(), 10) + "\n")
+	}
+	_, err := buf.WriteTo(w)
+	return len(keys), err
+}
+
+func seriesKey(measurement string, tags []*dto.LabelPair) string {
+	var b strings.Builder
+	b.WriteString(measurement)
+	for _, t := range tags {
+		b.WriteString("\xff" + t.GetName() + "\xff" + t.GetValue())
+	}
+	return b.String()
+}
+
+// escape escapes backslashes and the characters in special with a backslash.
+func escape(s, special string) string {
+	if !strings.ContainsAny(s, special+`\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Enabled returns whether writing to InfluxDB is configured.
+func Enabled() bool {
+	return *url != ""
+}
+
+// Sink writes background polled metrics to the InfluxDB v2 write API, implemented as per the poll.Sink interface.
+type Sink struct {
+	client   *http.Client
+	writeURL string
+	writes   sync.WaitGroup
+}
+
+// New returns a new Sink.
+func New() (*Sink, error) {
+	if *org == "" || *bucket == "" {
+		return nil, fmt.Errorf("--influx.org and --influx.bucket must be specified")
+	}
+	u, err := neturl.Parse(*url)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse --influx.url: %v", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	u.RawQuery = neturl.Values{"org": {*org}, "bucket": {*bucket}, "precision": {"ns"}}.Encode()
+	if _, err := token(); err != nil {
+		return nil, err
+	}
+	return &Sink{client: &http.Client{Timeout: *timeout}, writeURL: u.String()}, nil
+}
+
+// Write implemented as per the poll.Sink interface. Metrics that cannot be written are not retried.
+func (s *Sink) Write(results []*poll.Result) {
+	s.writes.Add(1)
+	go func() {
+		defer s.writes.Done()
+		var buf bytes.Buffer
+		lines := 0
+		for _, r := range results {
+			n, _ := Encode(&buf, r.Families, r.Time)
+			lines += n
+		}
+		if lines == 0 {
+			return
+		}
+		if err := s.write(&buf); err != nil {
+			writeFailures.Inc()
+			slog.Error("cannot write to influxdb", "lines", lines, "err", err)
+			return
+		}
+		linesWritten.Add(float64(lines))
+	}()
+}
+
+// Close implemented as per the poll.Closer interface, waiting for writes in progress.
+func (s *Sink) Close(ctx context.Context) error {
+	return poll.Wait(ctx, &s.writes)
+}
+
+func (s *Sink) write(body io.Reader) error {
+	req, err := http.NewRequest(http.MethodPost, s.writeURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	t, err := token()
+	if err != nil {
+		return err
+	}
+	if t != "" {
+		req.Header.Set("Authorization", "Token "+t)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("incorrect status code received from influxdb: %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// token returns the InfluxDB API token, re-read from the token file on every call.
+func token() (string, error) {
+	if *tokenFile == "" {
+		return "", nil
+	}
+	t, err := ioutil.ReadFile(*tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot read influx token file: %v", err)
+	}
+	return strings.TrimSpace(string(t)), nil
+}
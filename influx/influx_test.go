@@ -0,0 +1,118 @@
+package influx
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEscape(t *testing.T) {
+	for _, test := range []struct {
+		s, special, expected string
+	}{
+		{"outlets", ", ", "outlets"},
+		{"rack 1,row=2", ",= ", `rack\ 1\,row\=2`},
+		{`C:\pdu`, ",= ", `C:\\pdu`},
+		{"a=b", ", ", "a=b"},
+		{"ünï code", ",= ", `ünï\ code`},
+		{"", ",= ", ""},
+	} {
+		if got := escape(test.s, test.special); got != test.expected {
+			t.Errorf("escape(%q, %q): expected %q, got %q", test.s, test.special, test.expected, got)
+		}
+	}
+}
+
+func gauge(name string, value float64, labels ...string) *dto.MetricFamily {
+	m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+	for i := 0; i < len(labels); i += 2 {
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	return &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{m}}
+}
+
+func TestEncode(t *testing.T) {
+	ts := time.Unix(1700000000, 5)
+
+	for _, test := range []struct {
+		name     string
+		families []*dto.MetricFamily
+		expected string
+		lines    int
+	}{
+		{
+			name: "fields with the same tags on one line",
+			families: []*dto.MetricFamily{
+				gauge("servertech_outlets_watts", 120.5, "instance", "pdu1", "id", "AA1"),
+				gauge("servertech_outlets_amperes", 0.5, "id", "AA1", "instance", "pdu1"),
+				gauge("servertech_outlets_watts", 10, "instance", "pdu1", "id", "AA2"),
+			},
+			expected: "outlets,id=AA1,instance=pdu1 amperes=0.5,watts=120.5 1700000000000000005\n" +
+				"outlets,id=AA2,instance=pdu1 watts=10 1700000000000000005\n",
+			lines: 2,
+		},
+		{
+			name: "tags escaped",
+			families: []*dto.MetricFamily{
+				gauge("servertech_outlets_watts", 1, "name", `Rack 1, Row=2\A`),
+			},
+			expected: `outlets,name=Rack\ 1\,\ Row\=2\\A watts=1 1700000000000000005` + "\n",
+			lines:    1,
+		},
+		{
+			name: "empty tags omitted",
+			families: []*dto.MetricFamily{
+				gauge("servertech_cords_watts", 1, "id", "AA", "name", ""),
+			},
+			expected: "cords,id=AA watts=1 1700000000000000005\n",
+			lines:    1,
+		},
+		{
+			name: "values that are not finite omitted",
+			families: []*dto.MetricFamily{
+				gauge("servertech_phases_volts", math.NaN(), "id", "AA1"),
+				gauge("servertech_phases_volt_deviation", math.Inf(1), "id", "AA1"),
+				gauge("servertech_phases_watts", 2, "id", "AA1"),
+			},
+			expected: "phases,id=AA1 watts=2 1700000000000000005\n",
+			lines:    1,
+		},
+		{
+			name: "exporter metrics",
+			families: []*dto.MetricFamily{
+				gauge("servertech_scrape_duration_seconds", 0.25),
+				{
+					Name: proto.String("servertech_jaws_request_duration_seconds"),
+					Type: dto.MetricType_HISTOGRAM.Enum(),
+					Metric: []*dto.Metric{{Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(3),
+						SampleSum:   proto.Float64(1.5),
+					}}},
+				},
+			},
+			expected: "servertech jaws_request_duration_seconds_count=3,jaws_request_duration_seconds_sum=1.5,scrape_duration_seconds=0.25 1700000000000000005\n",
+			lines:    1,
+		},
+		{
+			name: "no metrics",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			lines, err := Encode(&buf, test.families, ts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if buf.String() != test.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", test.expected, buf.String())
+			}
+			if lines != test.lines {
+				t.Errorf("expected %d lines, got %d", test.lines, lines)
+			}
+		})
+	}
+}
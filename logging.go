@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+)
+
+// maxRepeatedErrors is the number of distinct errors tracked for rate limiting, after which those not logged within
+// the repeat interval are forgotten, then the least recently logged.
+const maxRepeatedErrors = 10000
+
+var (
+	logRepeatInterval = kingpin.Flag("log.repeat-interval", "Interval at which identical warnings and errors of the same target are logged, with the number suppressed since. All are logged if 0.").Default("5m").Duration()
+
+	// repeatKeys are the attributes identifying repeated warnings and errors, along with the level and message.
+	repeatKeys = map[string]bool{"target": true, "module": true, "collector": true, "jaws_path": true, "err": true}
+)
+
+type requestLoggerKey struct{}
+
+// requestLogger returns the logger of r, with its request ID added, or slog.Default() if it has none.
+func requestLogger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(requestLoggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// logHandler adds a logger with a request ID to the context of requests, taken from the X-Request-Id header if set
+// or otherwise generated, and returns the ID in the X-Request-Id response header. Requests are logged at the debug
+// level.
+type logHandler struct {
+	handler http.Handler
+}
+
+func (h *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" || len(id) > 64 {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set("X-Request-Id", id)
+	logger := slog.Default().With("request_id", id)
+
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	h.handler.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), requestLoggerKey{}, logger)))
+	logger.Debug("request", "method", r.Method, "path", r.URL.Path, "target", r.URL.Query().Get("target"), "status", sw.status, "duration", time.Since(start))
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implemented as per the http.Flusher interface, for streaming responses.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// repeatHandler is a slog.Handler that rate limits repeated warnings and errors. Records with the same level,
+// message and repeatKeys attributes are logged at most once per interval, with the number suppressed since the last
+// was logged as the 'repeated' attribute.
+type repeatHandler struct {
+	handler  slog.Handler
+	interval time.Duration
+	// attrs are the repeatKeys attributes added using WithAttrs.
+	attrs []string
+	state *repeatState
+}
+
+type repeatState struct {
+	mu      sync.Mutex
+	records map[string]*repeatedRecord
+}
+
+type repeatedRecord struct {
+	logged     time.Time
+	suppressed int
+}
+
+func newRepeatHandler(handler slog.Handler, interval time.Duration) slog.Handler {
+	if interval <= 0 {
+		return handler
+	}
+	return &repeatHandler{handler: handler, interval: interval, state: &repeatState{records: make(map[string]*repeatedRecord)}}
+}
+
+// Enabled implemented as per the slog.Handler interface.
+func (h *repeatHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+// Handle implemented as per the slog.Handler interface.
+func (h *repeatHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.handler.Handle(ctx, r)
+	}
+	key := append([]string{r.Level.String(), r.Message}, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		if repeatKeys[a.Key] {
+			key = append(key, a.Key+"="+a.Value.Resolve().String())
+		}
+		return true
+	})
+
+	suppressed, ok := h.state.log(strings.Join(key, "\x00"), r.Time, h.interval)
+	if !ok {
+		return nil
+	}
+	if suppressed > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("repeated", suppressed))
+	}
+	return h.handler.Handle(ctx, r)
+}
+
+// log returns whether a record with key logged at now should be logged, and if so the number of records with key
+// suppressed since one was last logged.
+func (s *repeatState) log(key string, now time.Time, interval time.Duration) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.records[key]; ok && now.Sub(rec.logged) < interval {
+		rec.suppressed++
+		return 0, false
+	}
+	suppressed := 0
+	if rec, ok := s.records[key]; ok {
+		suppressed = rec.suppressed
+	} else if len(s.records) >= maxRepeatedErrors {
+		for k, rec := range s.records {
+			if now.Sub(rec.logged) >= interval {
+				delete(s.records, k)
+			}
+		}
+		if len(s.records) >= maxRepeatedErrors {
+			s.dropLeastRecent()
+		}
+	}
+	s.records[key] = &repeatedRecord{logged: now}
+	return suppressed, true
+}
+
+// dropLeastRecent drops the record that was logged least recently, so that distinct keys logged within the interval
+// cannot grow the records beyond maxRepeatedErrors. Its suppressed records are not reported.
+func (s *repeatState) dropLeastRecent() {
+	var oldest string
+	for k, rec := range s.records {
+		if oldest == "" || rec.logged.Before(s.records[oldest].logged) {
+			oldest = k
+		}
+	}
+	delete(s.records, oldest)
+}
+
+// WithAttrs implemented as per the slog.Handler interface.
+func (h *repeatHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	keys := append([]string{}, h.attrs...)
+	for _, a := range attrs {
+		if repeatKeys[a.Key] {
+			keys = append(keys, a.Key+"="+a.Value.Resolve().String())
+		}
+	}
+	return &repeatHandler{handler: h.handler.WithAttrs(attrs), interval: h.interval, attrs: keys, state: h.state}
+}
+
+// WithGroup implemented as per the slog.Handler interface.
+func (h *repeatHandler) WithGroup(name string) slog.Handler {
+	return &repeatHandler{handler: h.handler.WithGroup(name), interval: h.interval, attrs: h.attrs, state: h.state}
+}
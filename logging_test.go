@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepeatHandler(t *testing.T) {
+	var buf bytes.Buffer
+	text := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	handler := newRepeatHandler(text, time.Minute)
+	pdu1 := handler.WithAttrs([]slog.Attr{slog.String("target", "pdu1"), slog.String("request_id", "1")})
+	pdu2 := handler.WithAttrs([]slog.Attr{slog.String("target", "pdu2")})
+	start := time.Unix(1700000000, 0)
+
+	for i, test := range []struct {
+		handler slog.Handler
+		offset  time.Duration
+		level   slog.Level
+		msg     string
+		err     string
+		// Expected output, empty if suppressed.
+		expected string
+	}{
+		{pdu1, 0, slog.LevelError, "scrape failed", "timeout", `level=ERROR msg="scrape failed" target=pdu1 request_id=1 err=timeout`},
+		{pdu1, time.Second, slog.LevelError, "scrape failed", "timeout", ""},
+		{pdu1, 2 * time.Second, slog.LevelError, "scrape failed", "timeout", ""},
+		// Different targets, errors, messages and levels are not repeats.
+		{pdu2, 3 * time.Second, slog.LevelError, "scrape failed", "timeout", `level=ERROR msg="scrape failed" target=pdu2 err=timeout`},
+		{pdu1, 4 * time.Second, slog.LevelError, "scrape failed", "refused", `level=ERROR msg="scrape failed" target=pdu1 request_id=1 err=refused`},
+		{pdu1, 5 * time.Second, slog.LevelError, "poll failed", "timeout", `level=ERROR msg="poll failed" target=pdu1 request_id=1 err=timeout`},
+		{pdu1, 6 * time.Second, slog.LevelWarn, "scrape failed", "timeout", `level=WARN msg="scrape failed" target=pdu1 request_id=1 err=timeout`},
+		// Info and debug records are never suppressed.
+		{pdu1, 7 * time.Second, slog.LevelInfo, "scrape failed", "timeout", `level=INFO msg="scrape failed" target=pdu1 request_id=1 err=timeout`},
+		{pdu1, 8 * time.Second, slog.LevelInfo, "scrape failed", "timeout", `level=INFO msg="scrape failed" target=pdu1 request_id=1 err=timeout`},
+		// Logged again after the interval, with the number suppressed.
+		{pdu1, time.Minute, slog.LevelError, "scrape failed", "timeout", `level=ERROR msg="scrape failed" target=pdu1 request_id=1 err=timeout repeated=2`},
+		{pdu1, time.Minute + time.Second, slog.LevelError, "scrape failed", "timeout", ""},
+		{pdu1, 3 * time.Minute, slog.LevelError, "scrape failed", "timeout", `level=ERROR msg="scrape failed" target=pdu1 request_id=1 err=timeout repeated=1`},
+		{pdu1, 5 * time.Minute, slog.LevelError, "scrape failed", "timeout", `level=ERROR msg="scrape failed" target=pdu1 request_id=1 err=timeout`},
+	} {
+		buf.Reset()
+		r := slog.NewRecord(start.Add(test.offset), test.level, test.msg, 0)
+		r.AddAttrs(slog.String("err", test.err))
+		if err := test.handler.Handle(context.Background(), r); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if got := strings.TrimSuffix(buf.String(), "\n"); got != test.expected {
+			t.Errorf("%d: expected %q, got %q", i, test.expected, got)
+		}
+	}
+}
+
+func TestRepeatHandlerDisabled(t *testing.T) {
+	text := slog.NewTextHandler(&bytes.Buffer{}, nil)
+	if handler := newRepeatHandler(text, 0); handler != text {
+		t.Error("expected handler not to be wrapped with a repeat interval of 0")
+	}
+}
+
+func TestRepeatStateBounded(t *testing.T) {
+	s := &repeatState{records: make(map[string]*repeatedRecord)}
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < maxRepeatedErrors; i++ {
+		s.log(strconv.Itoa(i), start.Add(time.Duration(i)*time.Millisecond), time.Hour)
+	}
+
+	// Within the interval of every record, a new key drops the least recently logged record.
+	if _, ok := s.log("new", start.Add(time.Minute), time.Hour); !ok {
+		t.Error("expected new key to be logged")
+	}
+	if len(s.records) != maxRepeatedErrors {
+		t.Errorf("expected %d records, got %d", maxRepeatedErrors, len(s.records))
+	}
+	if _, ok := s.records["0"]; ok {
+		t.Error("expected least recently logged record to be dropped")
+	}
+
+	// Records logged outside the interval are dropped first.
+	s.log("newer", start.Add(2*time.Hour), time.Hour)
+	if len(s.records) != 1 {
+		t.Errorf("expected 1 record, got %d", len(s.records))
+	}
+}
@@ -0,0 +1,192 @@
+// Package modbus serves the readings of background polled PDUs over Modbus TCP, for building management systems.
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/poll"
+)
+
+const (
+	readHoldingRegisters = 0x03
+	readInputRegisters   = 0x04
+
+	// maxReadRegisters is the maximum number of registers a single request may read.
+	maxReadRegisters = 125
+
+	exceptionIllegalFunction = 0x01
+	exceptionIllegalAddress  = 0x02
+	exceptionIllegalValue    = 0x03
+	exceptionTargetFailed    = 0x0B
+
+	idleTimeout = 5 * time.Minute
+)
+
+var (
+	listenAddress = kingpin.Flag("modbus.listen-address", "Address on which to serve the readings of background polled targets over Modbus TCP, e.g. :502. Modbus is disabled if not specified.").String()
+
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servertech_modbus_requests_total",
+		Help: "Total number of Modbus requests, by result (ok, illegal_function, illegal_address, illegal_value, unavailable).",
+	}, []string{"result"})
+
+	exceptionResults = map[byte]string{
+		exceptionIllegalFunction: "illegal_function",
+		exceptionIllegalAddress:  "illegal_address",
+		exceptionIllegalValue:    "illegal_value",
+		exceptionTargetFailed:    "unavailable",
+	}
+)
+
+func init() {
+	requests.WithLabelValues("ok")
+	for _, result := range exceptionResults {
+		requests.WithLabelValues(result)
+	}
+	prometheus.MustRegister(requests)
+}
+
+// Enabled returns whether the Modbus TCP server is enabled.
+func Enabled() bool {
+	return *listenAddress != ""
+}
+
+// Sink serves the readings of background polled targets with a Modbus unit ID over Modbus TCP, implemented as per
+// the poll.Sink interface.
+type Sink struct {
+	blocks   []Block
+	listener net.Listener
+
+	mu     sync.RWMutex
+	images map[byte]*image
+}
+
+// New returns a new Sink, and starts serving Modbus TCP.
+func New() (*Sink, error) {
+	l, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for modbus: %v", err)
+	}
+	s := &Sink{blocks: RegisterMap(), listener: l, images: make(map[byte]*image)}
+	go s.serve()
+	return s, nil
+}
+
+// Write implemented as per the poll.Sink interface.
+func (s *Sink) Write(results []*poll.Result) {
+	for _, r := range results {
+		if r.Target.ModbusUnitID == 0 {
+			continue
+		}
+		img := newImage(s.blocks, r.Time, r.Families)
+		s.mu.Lock()
+		s.images[byte(r.Target.ModbusUnitID)] = img
+		s.mu.Unlock()
+	}
+}
+
+// Close implemented as per the poll.Closer interface, no longer accepting connections.
+func (s *Sink) Close(ctx context.Context) error {
+	return s.listener.Close()
+}
+
+func (s *Sink) serve() {
+	slog.Info("serving modbus", "address", s.listener.Addr().String())
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("cannot accept modbus connection", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle serves the requests of a connection until it is closed or idle.
+func (s *Sink) handle(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 7)
+	for {
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF {
+				slog.Debug("modbus connection closed", "remote_addr", conn.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+		// The MBAP header is the transaction ID, protocol ID (0 for Modbus), length of the unit ID and PDU, and unit ID.
+		length := binary.BigEndian.Uint16(header[4:6])
+		if binary.BigEndian.Uint16(header[2:4]) != 0 || length < 2 || length > 254 {
+			slog.Debug("invalid modbus header", "remote_addr", conn.RemoteAddr().String())
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		resp := s.respond(header[6], pdu)
+		binary.BigEndian.PutUint16(header[4:6], uint16(len(resp)+1))
+		if _, err := conn.Write(append(header, resp...)); err != nil {
+			return
+		}
+		header = header[:7]
+	}
+}
+
+// respond returns the response PDU to a request PDU for unit.
+func (s *Sink) respond(unit byte, pdu []byte) []byte {
+	function := pdu[0]
+	exception := func(code byte) []byte {
+		requests.WithLabelValues(exceptionResults[code]).Inc()
+		return []byte{function | 0x80, code}
+	}
+
+	if function != readHoldingRegisters && function != readInputRegisters {
+		return exception(exceptionIllegalFunction)
+	}
+	if len(pdu) != 5 {
+		return exception(exceptionIllegalValue)
+	}
+	address, quantity := int(binary.BigEndian.Uint16(pdu[1:3])), int(binary.BigEndian.Uint16(pdu[3:5]))
+	if quantity < 1 || quantity > maxReadRegisters {
+		return exception(exceptionIllegalValue)
+	}
+	if address+quantity > registerCount(s.blocks) {
+		return exception(exceptionIllegalAddress)
+	}
+
+	s.mu.RLock()
+	img, ok := s.images[unit]
+	s.mu.RUnlock()
+	if !ok {
+		return exception(exceptionTargetFailed)
+	}
+
+	resp := make([]byte, 2, 2+quantity*2)
+	resp[0], resp[1] = function, byte(quantity*2)
+	for a := address; a < address+quantity; a++ {
+		v := img.registers[a]
+		if a == 1 {
+			v = uint16(math.Min(time.Since(img.time).Seconds(), math.MaxUint16))
+		}
+		resp = binary.BigEndian.AppendUint16(resp, v)
+	}
+	requests.WithLabelValues("ok").Inc()
+	return resp
+}
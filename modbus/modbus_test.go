@@ -0,0 +1,76 @@
+package modbus
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRespond(t *testing.T) {
+	blocks := RegisterMap()
+	img := newImage(blocks, time.Now(), nil)
+	img.registers[100], img.registers[101] = 0x4366, 0x8000
+	s := &Sink{blocks: blocks, images: map[byte]*image{5: img}}
+
+	for _, test := range []struct {
+		name     string
+		unit     byte
+		pdu      []byte
+		expected []byte
+	}{
+		{
+			name:     "read holding registers",
+			unit:     5,
+			pdu:      []byte{readHoldingRegisters, 0, 100, 0, 2},
+			expected: []byte{readHoldingRegisters, 4, 0x43, 0x66, 0x80, 0x00},
+		},
+		{
+			name:     "read input registers",
+			unit:     5,
+			pdu:      []byte{readInputRegisters, 0, 0, 0, 1},
+			expected: []byte{readInputRegisters, 2, 0, registerMapVersion},
+		},
+		{
+			name:     "poll age",
+			unit:     5,
+			pdu:      []byte{readInputRegisters, 0, 1, 0, 1},
+			expected: []byte{readInputRegisters, 2, 0, 0},
+		},
+		{
+			name:     "illegal function",
+			unit:     5,
+			pdu:      []byte{0x06, 0, 100, 0, 1},
+			expected: []byte{0x86, exceptionIllegalFunction},
+		},
+		{
+			name:     "invalid length",
+			unit:     5,
+			pdu:      []byte{readHoldingRegisters, 0, 100, 0},
+			expected: []byte{readHoldingRegisters | 0x80, exceptionIllegalValue},
+		},
+		{
+			name:     "too many registers",
+			unit:     5,
+			pdu:      []byte{readHoldingRegisters, 0, 0, 0, maxReadRegisters + 1},
+			expected: []byte{readHoldingRegisters | 0x80, exceptionIllegalValue},
+		},
+		{
+			name:     "beyond register map",
+			unit:     5,
+			pdu:      []byte{readHoldingRegisters, 0x01, 0xa3, 0, 2},
+			expected: []byte{readHoldingRegisters | 0x80, exceptionIllegalAddress},
+		},
+		{
+			name:     "unit not polled",
+			unit:     6,
+			pdu:      []byte{readHoldingRegisters, 0, 100, 0, 2},
+			expected: []byte{readHoldingRegisters | 0x80, exceptionTargetFailed},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if resp := s.respond(test.unit, test.pdu); !bytes.Equal(resp, test.expected) {
+				t.Errorf("expected % x, got % x", test.expected, resp)
+			}
+		})
+	}
+}
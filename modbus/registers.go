@@ -0,0 +1,149 @@
+package modbus
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tynany/servertech_exporter/collector"
+)
+
+const (
+	// registerMapVersion is incremented whenever existing register addresses change.
+	registerMapVersion = 1
+
+	// The header holds the register map version, poll age and number of entities in each block.
+	headerRegisters   = 100
+	entityCountOffset = 10
+
+	// Each block holds a metric of up to blockSlots entities, as 32-bit floats.
+	blockSlots     = 32
+	blockRegisters = blockSlots * 2
+)
+
+// Block is a range of registers holding a metric of the entities of a subsystem.
+type Block struct {
+	Address int
+	collector.MetricInfo
+}
+
+// blockMetrics are the metrics served, in register order. Metrics must only be appended, so that register
+// addresses are stable.
+var blockMetrics = []struct{ subsystem, name string }{
+	{"phases", "volts"},
+	{"phases", "amperes"},
+	{"phases", "watts"},
+	{"cords", "kilowatthours"},
+	{"branches", "amperes"},
+}
+
+// RegisterMap returns the blocks of registers served, generated from the collectors' metric descriptions.
+func RegisterMap() []Block {
+	blocks := make([]Block, 0, len(blockMetrics))
+	for i, m := range blockMetrics {
+		info, ok := collector.LookupMetric(m.subsystem, m.name)
+		if !ok {
+			panic(fmt.Sprintf("modbus register map metric %s %s has no collector description", m.subsystem, m.name))
+		}
+		blocks = append(blocks, Block{Address: headerRegisters + i*blockRegisters, MetricInfo: info})
+	}
+	return blocks
+}
+
+// registerCount is the number of registers in the register map.
+func registerCount(blocks []Block) int {
+	return headerRegisters + len(blocks)*blockRegisters
+}
+
+// image is the registers of a polled target.
+type image struct {
+	time      time.Time
+	registers []uint16
+}
+
+// newImage returns the registers of polled metrics. Slots of a block are the subsystem's entities sorted by ID
+// (unit, then cord, then position). Slots of entities without a value are NaN.
+func newImage(blocks []Block, polled time.Time, families []*dto.MetricFamily) *image {
+	img := &image{time: polled, registers: make([]uint16, registerCount(blocks))}
+	img.registers[0] = registerMapVersion
+
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+
+	slots := make(map[string]map[string]int)
+	for i, b := range blocks {
+		entitySlots, ok := slots[b.Subsystem]
+		if !ok {
+			entitySlots = subsystemSlots(byName["servertech_"+b.Subsystem+"_info"])
+			slots[b.Subsystem] = entitySlots
+		}
+		img.registers[entityCountOffset+i] = uint16(len(entitySlots))
+
+		for slot := 0; slot < blockSlots; slot++ {
+			img.setFloat(b.Address+slot*2, float32(math.NaN()))
+		}
+		for _, m := range byName[b.FQName].GetMetric() {
+			slot, ok := entitySlots[labelValue(m, "id")]
+			if !ok {
+				continue
+			}
+			img.setFloat(b.Address+slot*2, float32(m.GetGauge().GetValue()))
+		}
+	}
+	return img
+}
+
+func (img *image) setFloat(address int, v float32) {
+	bits := math.Float32bits(v)
+	img.registers[address], img.registers[address+1] = uint16(bits>>16), uint16(bits)
+}
+
+// subsystemSlots returns the slots of the entities of a subsystem by ID, from the subsystem's info metric. Entities
+// beyond the number of slots in a block are not served.
+func subsystemSlots(info *dto.MetricFamily) map[string]int {
+	type entity struct {
+		id, unit, cord string
+		position       int
+	}
+	var entities []entity
+	for _, m := range info.GetMetric() {
+		position, _ := strconv.Atoi(labelValue(m, "position"))
+		entities = append(entities, entity{labelValue(m, "id"), labelValue(m, "unit_id"), labelValue(m, "cord_id"), position})
+	}
+	sort.Slice(entities, func(i, j int) bool {
+		a, b := entities[i], entities[j]
+		if a.unit != b.unit {
+			return a.unit < b.unit
+		}
+		if a.cord != b.cord {
+			return a.cord < b.cord
+		}
+		if a.position != b.position {
+			return a.position < b.position
+		}
+		return a.id < b.id
+	})
+
+	slots := make(map[string]int, len(entities))
+	for i, e := range entities {
+		if i == blockSlots {
+			break
+		}
+		slots[e.id] = i
+	}
+	return slots
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
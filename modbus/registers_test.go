@@ -0,0 +1,113 @@
+package modbus
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestRegisterMap checks register addresses are stable, as building management systems are configured with them.
+func TestRegisterMap(t *testing.T) {
+	expected := []struct {
+		address int
+		name    string
+	}{
+		{100, "servertech_phases_volts"},
+		{164, "servertech_phases_amperes"},
+		{228, "servertech_phases_watts"},
+		{292, "servertech_cords_kilowatthours"},
+		{356, "servertech_branches_amperes"},
+	}
+	blocks := RegisterMap()
+	if len(blocks) != len(expected) {
+		t.Fatalf("expected %d blocks, got %d", len(expected), len(blocks))
+	}
+	for i, e := range expected {
+		if blocks[i].Address != e.address || blocks[i].FQName != e.name {
+			t.Errorf("block %d: expected %s at %d, got %s at %d", i, e.name, e.address, blocks[i].FQName, blocks[i].Address)
+		}
+	}
+	if n := registerCount(blocks); n != 420 {
+		t.Errorf("expected 420 registers, got %d", n)
+	}
+}
+
+func metric(value float64, labels ...string) *dto.Metric {
+	m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+	for i := 0; i < len(labels); i += 2 {
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	return m
+}
+
+func family(name string, metrics ...*dto.Metric) *dto.MetricFamily {
+	return &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum(), Metric: metrics}
+}
+
+func float(img *image, address int) float32 {
+	return math.Float32frombits(uint32(img.registers[address])<<16 | uint32(img.registers[address+1]))
+}
+
+func TestNewImage(t *testing.T) {
+	blocks := RegisterMap()
+	volts, amperes := blocks[0].Address, blocks[1].Address
+
+	img := newImage(blocks, time.Now(), []*dto.MetricFamily{
+		// Phases of two cords, out of order, which are slotted by unit, cord, then position.
+		family("servertech_phases_info",
+			metric(1, "id", "AB2", "unit_id", "A", "cord_id", "AB", "position", "2"),
+			metric(1, "id", "AA10", "unit_id", "A", "cord_id", "AA", "position", "10"),
+			metric(1, "id", "AA2", "unit_id", "A", "cord_id", "AA", "position", "2"),
+		),
+		family("servertech_phases_volts",
+			metric(230.5, "id", "AA2"),
+			metric(231, "id", "AA10"),
+			metric(232, "id", "AB2"),
+			// Metrics of entities without an info metric are not served.
+			metric(233, "id", "AC1"),
+		),
+		family("servertech_phases_amperes", metric(1.5, "id", "AA10")),
+	})
+
+	if img.registers[0] != registerMapVersion {
+		t.Errorf("expected register map version %d, got %d", registerMapVersion, img.registers[0])
+	}
+	for i, expected := range []uint16{3, 3, 3, 0, 0} {
+		if n := img.registers[entityCountOffset+i]; n != expected {
+			t.Errorf("block %d: expected %d entities, got %d", i, expected, n)
+		}
+	}
+	for _, test := range []struct {
+		address  int
+		expected float32
+	}{
+		{volts, 230.5},
+		{volts + 2, 231},
+		{volts + 4, 232},
+		{amperes + 2, 1.5},
+	} {
+		if v := float(img, test.address); v != test.expected {
+			t.Errorf("register %d: expected %g, got %g", test.address, test.expected, v)
+		}
+	}
+	// Slots without a value are NaN.
+	for _, address := range []int{volts + 6, amperes, amperes + 4, blocks[4].Address + blockRegisters - 2} {
+		if v := float(img, address); !math.IsNaN(float64(v)) {
+			t.Errorf("register %d: expected NaN, got %g", address, v)
+		}
+	}
+}
+
+func TestSubsystemSlotsLimited(t *testing.T) {
+	var metrics []*dto.Metric
+	for i := 0; i < blockSlots+5; i++ {
+		metrics = append(metrics, metric(1, "id", "AA"+strconv.Itoa(i), "position", strconv.Itoa(i)))
+	}
+	if n := len(subsystemSlots(family("servertech_outlets_info", metrics...))); n != blockSlots {
+		t.Errorf("expected %d slots, got %d", blockSlots, n)
+	}
+}
@@ -0,0 +1,314 @@
+// Package mqtt publishes the readings of background polled PDUs to an MQTT broker.
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/collector"
+	"github.com/tynany/servertech_exporter/poll"
+)
+
+const publishTimeout = 10 * time.Second
+
+var (
+	broker              = kingpin.Flag("mqtt.broker", "URL of the MQTT broker readings of background polled targets are published to, e.g. tcp://mosquitto:1883 or ssl://mosquitto:8883.").String()
+	clientID            = kingpin.Flag("mqtt.client-id", "MQTT client ID.").Default("servertech_exporter").String()
+	username            = kingpin.Flag("mqtt.username", "Username for authentication to the MQTT broker.").String()
+	passwordFile        = kingpin.Flag("mqtt.password-file", "Path to a file containing the password for authentication to the MQTT broker.").String()
+	qos                 = kingpin.Flag("mqtt.qos", "QoS of published messages (0, 1 or 2).").Default("1").Uint8()
+	topicTemplate       = kingpin.Flag("mqtt.topic-template", "Go template of the topic readings are published to. The template is passed .Target, .Subsystem and .ID, which is empty for the system subsystem.").Default("servertech/{{.Target}}/{{.Subsystem}}{{with .ID}}/{{.}}{{end}}").String()
+	statusTopicTemplate = kingpin.Flag("mqtt.status-topic-template", "Go template of the topic state and status changes are published to as retained messages, passed the same as --mqtt.topic-template.").Default("servertech/{{.Target}}/{{.Subsystem}}{{with .ID}}/{{.}}{{end}}/status").String()
+	tlsCAFile           = kingpin.Flag("mqtt.tls.ca-file", "Path to the CA certificate bundle used to verify the MQTT broker's certificate. The system CAs are used if not specified.").String()
+	tlsCertFile         = kingpin.Flag("mqtt.tls.cert-file", "Path to the client certificate presented to the MQTT broker.").String()
+	tlsKeyFile          = kingpin.Flag("mqtt.tls.key-file", "Path to the key of the client certificate presented to the MQTT broker.").String()
+	tlsInsecure         = kingpin.Flag("mqtt.tls.insecure-skip-verify", "Do not verify the MQTT broker's certificate.").Default("False").Bool()
+
+	messagesPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "servertech_mqtt_messages_published_total",
+		Help: "Total number of messages successfully published to the MQTT broker.",
+	})
+	publishFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "servertech_mqtt_publish_failures_total",
+		Help: "Total number of messages that could not be published to the MQTT broker.",
+	})
+
+	// topicReplacer replaces characters that cannot be used in a topic level, or would add levels.
+	topicReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+)
+
+func init() {
+	prometheus.MustRegister(messagesPublished, publishFailures)
+}
+
+// Enabled returns whether publishing to an MQTT broker is configured.
+func Enabled() bool {
+	return *broker != ""
+}
+
+// topicData is passed to the topic templates.
+type topicData struct {
+	Target, Subsystem, ID string
+}
+
+// Sink publishes the readings of background polled targets to an MQTT broker, implemented as per the poll.Sink
+// interface. The readings of each entity are published as JSON to its topic. Its state, control state and statuses
+// are also published as a retained message to its status topic when first polled and whenever they change. Polls are
+// published in order by a single worker.
+type Sink struct {
+	client      paho.Client
+	topic       *template.Template
+	statusTopic *template.Template
+	// polls holds the next poll to publish. If the worker is still publishing when another poll is written, the
+	// pending poll is replaced, as only the latest readings are of interest.
+	polls  chan []*poll.Result
+	worker sync.WaitGroup
+
+	// lastStatus is the last status published to each status topic, only accessed by the worker.
+	lastStatus map[string]string
+}
+
+// New returns a new Sink, and connects to the broker in the background.
+func New() (*Sink, error) {
+	if *qos > 2 {
+		return nil, fmt.Errorf("--mqtt.qos must be 0, 1 or 2")
+	}
+	topic, err := template.New("topic").Option("missingkey=error").Parse(*topicTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse --mqtt.topic-template: %v", err)
+	}
+	statusTopic, err := template.New("status topic").Option("missingkey=error").Parse(*statusTopicTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse --mqtt.status-topic-template: %v", err)
+	}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(*broker).
+		SetClientID(*clientID).
+		SetTLSConfig(tlsConfig).
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(func(paho.Client) { slog.Info("connected to mqtt broker", "broker", *broker) }).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			slog.Error("lost connection to mqtt broker", "broker", *broker, "err", err)
+		})
+	if *username != "" {
+		if _, _, err := credentials(); err != nil {
+			return nil, err
+		}
+		opts.SetCredentialsProvider(func() (string, string) {
+			user, password, err := credentials()
+			if err != nil {
+				slog.Error("cannot get mqtt credentials", "err", err)
+			}
+			return user, password
+		})
+	}
+
+	client := paho.NewClient(opts)
+	// With connect retry, the token completes once the first attempt is made, and connecting continues in the
+	// background if it failed.
+	client.Connect()
+
+	s := &Sink{
+		client:      client,
+		topic:       topic,
+		statusTopic: statusTopic,
+		polls:       make(chan []*poll.Result, 1),
+		lastStatus:  make(map[string]string),
+	}
+	s.worker.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// run publishes polls until the polls channel is closed.
+func (s *Sink) run() {
+	defer s.worker.Done()
+	for results := range s.polls {
+		for _, r := range results {
+			if r.Readings != nil {
+				s.publishReadings(r.Readings)
+			}
+		}
+	}
+}
+
+// credentials returns the username and password to authenticate to the broker with, re-reading the password file.
+func credentials() (string, string, error) {
+	if *passwordFile == "" {
+		return *username, "", nil
+	}
+	password, err := ioutil.ReadFile(*passwordFile)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot read mqtt password file: %v", err)
+	}
+	return *username, strings.TrimSpace(string(password)), nil
+}
+
+func newTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: *tlsInsecure}
+	if *tlsCAFile != "" {
+		caPEM, err := ioutil.ReadFile(*tlsCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read mqtt CA file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in mqtt CA file %q", *tlsCAFile)
+		}
+	}
+	if *tlsCertFile != "" || *tlsKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load mqtt client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Write implemented as per the poll.Sink interface. Write is only called by the poller, so once a pending poll is
+// replaced, sending cannot block.
+func (s *Sink) Write(results []*poll.Result) {
+	select {
+	case s.polls <- results:
+		return
+	default:
+	}
+	select {
+	case <-s.polls:
+		slog.Warn("dropping readings of a poll not yet published to mqtt broker, as publishing is slower than the poll interval")
+	default:
+	}
+	s.polls <- results
+}
+
+// Close implemented as per the poll.Closer interface, waiting for the pending poll to be published before
+// disconnecting from the broker.
+func (s *Sink) Close(ctx context.Context) error {
+	close(s.polls)
+	err := poll.Wait(ctx, &s.worker)
+	s.client.Disconnect(250)
+	return err
+}
+
+func (s *Sink) publishReadings(r *collector.Readings) {
+	if r.System != nil {
+		s.publishEntity(r, "system", "", r.System)
+	}
+	for _, e := range r.Units {
+		s.publishEntity(r, "units", e.ID, e)
+	}
+	for _, e := range r.Cords {
+		s.publishEntity(r, "cords", e.ID, e)
+	}
+	for _, e := range r.Lines {
+		s.publishEntity(r, "lines", e.ID, e)
+	}
+	for _, e := range r.Phases {
+		s.publishEntity(r, "phases", e.ID, e)
+	}
+	for _, e := range r.Branches {
+		s.publishEntity(r, "branches", e.ID, e)
+	}
+	for _, e := range r.Ocps {
+		s.publishEntity(r, "ocps", e.ID, e)
+	}
+	for _, e := range r.Outlets {
+		s.publishEntity(r, "outlets", e.ID, e)
+	}
+}
+
+// statusFields are the fields of an entity's readings published to its status topic.
+var statusFields = []string{"state", "control_state", "statuses"}
+
+// publishEntity publishes the readings of an entity, and its status if it has changed since it was last published.
+func (s *Sink) publishEntity(r *collector.Readings, subsystem, id string, entity interface{}) {
+	data := topicData{Target: topicReplacer.Replace(r.Target), Subsystem: subsystem, ID: topicReplacer.Replace(id)}
+	topic, err := execute(s.topic, data)
+	if err != nil {
+		slog.Error("cannot execute mqtt topic template", "err", err)
+		return
+	}
+	statusTopic, err := execute(s.statusTopic, data)
+	if err != nil {
+		slog.Error("cannot execute mqtt status topic template", "err", err)
+		return
+	}
+
+	// Entities are published as their readings JSON, with the target and time added.
+	var readings map[string]interface{}
+	b, err := json.Marshal(entity)
+	if err == nil {
+		err = json.Unmarshal(b, &readings)
+	}
+	if err != nil {
+		slog.Error("cannot marshal mqtt payload", "err", err)
+		return
+	}
+	status := make(map[string]interface{})
+	for _, f := range statusFields {
+		if v, ok := readings[f]; ok {
+			status[f] = v
+		}
+	}
+	statusKey, _ := json.Marshal(status)
+
+	readings["target"], readings["time"] = r.Target, r.Time
+	s.publish(topic, false, readings)
+
+	if s.lastStatus[statusTopic] == string(statusKey) {
+		return
+	}
+	status["target"], status["time"] = r.Target, r.Time
+	if s.publish(statusTopic, true, status) {
+		s.lastStatus[statusTopic] = string(statusKey)
+	}
+}
+
+func (s *Sink) publish(topic string, retained bool, v interface{}) bool {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("cannot marshal mqtt payload", "err", err)
+		return false
+	}
+	token := s.client.Publish(topic, *qos, retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		publishFailures.Inc()
+		slog.Error("timed out publishing to mqtt broker", "topic", topic)
+		return false
+	}
+	if err := token.Error(); err != nil {
+		publishFailures.Inc()
+		slog.Error("cannot publish to mqtt broker", "topic", topic, "err", err)
+		return false
+	}
+	messagesPublished.Inc()
+	return true
+}
+
+func execute(t *template.Template, data topicData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,303 @@
+// Package otlp exports background polled metrics to an OpenTelemetry collector using OTLP over gRPC or HTTP.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"github.com/tynany/servertech_exporter/poll"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	protocolGRPC = "grpc"
+	protocolHTTP = "http/protobuf"
+
+	scopeName = "github.com/tynany/servertech_exporter"
+)
+
+var (
+	endpoint = kingpin.Flag("otlp.endpoint", "OTLP endpoint background polled metrics are exported to: host:port for gRPC, e.g. otel-collector:4317, or a URL for HTTP, e.g. http://otel-collector:4318.").String()
+	protocol = kingpin.Flag("otlp.protocol", "OTLP protocol, one of: grpc, http/protobuf.").Default(protocolGRPC).Enum(protocolGRPC, protocolHTTP)
+	headers  = kingpin.Flag("otlp.header", "Header sent with OTLP exports, as name=value. May be repeated.").StringMap()
+	insec    = kingpin.Flag("otlp.insecure", "Export over gRPC without TLS.").Default("False").Bool()
+	timeout  = kingpin.Flag("otlp.timeout", "Timeout of OTLP exports.").Default("30s").Duration()
+
+	exportFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "servertech_otlp_export_failures_total",
+		Help: "Total number of failed OTLP exports of background polled metrics.",
+	})
+	dataPointsExported = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "servertech_otlp_data_points_exported_total",
+		Help: "Total number of data points successfully exported over OTLP.",
+	})
+
+	// ucumUnits are the UCUM units of the OpenMetrics units of metrics.
+	ucumUnits = map[string]string{
+		"volts":         "V",
+		"amperes":       "A",
+		"watts":         "W",
+		"voltamps":      "VA",
+		"joules":        "J",
+		"kilowatthours": "kW.h",
+		"hertz":         "Hz",
+		"seconds":       "s",
+		"ratio":         "1",
+		"bytes":         "By",
+	}
+)
+
+func init() {
+	prometheus.MustRegister(exportFailures, dataPointsExported)
+}
+
+// Enabled returns whether exporting over OTLP is configured.
+func Enabled() bool {
+	return *endpoint != ""
+}
+
+// Sink exports background polled metrics over OTLP, implemented as per the poll.Sink interface. Each target is
+// exported as a resource, with its name, PDU serial number, firmware version and configured labels as attributes.
+type Sink struct {
+	export  func(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) error
+	exports sync.WaitGroup
+}
+
+// New returns a new Sink.
+func New() (*Sink, error) {
+	s := &Sink{}
+	switch *protocol {
+	case protocolGRPC:
+		creds := credentials.NewTLS(&tls.Config{})
+		if *insec {
+			creds = insecure.NewCredentials()
+		}
+		conn, err := grpc.NewClient(*endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, fmt.Errorf("cannot create otlp grpc client: %v", err)
+		}
+		client := colmetricpb.NewMetricsServiceClient(conn)
+		s.export = func(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) error {
+			_, err := client.Export(metadata.NewOutgoingContext(ctx, metadata.New(*headers)), req)
+			return err
+		}
+	case protocolHTTP:
+		url := strings.TrimSuffix(*endpoint, "/")
+		if !strings.HasSuffix(url, "/v1/metrics") {
+			url += "/v1/metrics"
+		}
+		client := &http.Client{}
+		s.export = func(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) error {
+			return exportHTTP(ctx, client, url, req)
+		}
+	}
+	return s, nil
+}
+
+func exportHTTP(ctx context.Context, client *http.Client, url string, req *colmetricpb.ExportMetricsServiceRequest) error {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", "servertech_exporter/"+version.Version)
+	for k, v := range *headers {
+		httpReq.Header.Set(k, v)
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("incorrect status code received from otlp endpoint: %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// Write implemented as per the poll.Sink interface.
+func (s *Sink) Write(results []*poll.Result) {
+	s.exports.Add(1)
+	go func() {
+		defer s.exports.Done()
+		req := &colmetricpb.ExportMetricsServiceRequest{}
+		dataPoints := 0
+		for _, r := range results {
+			rm, n := resourceMetrics(r)
+			req.ResourceMetrics = append(req.ResourceMetrics, rm)
+			dataPoints += n
+		}
+		if dataPoints == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		if err := s.export(ctx, req); err != nil {
+			exportFailures.Inc()
+			slog.Error("cannot export over otlp", "data_points", dataPoints, "err", err)
+			return
+		}
+		dataPointsExported.Add(float64(dataPoints))
+	}()
+}
+
+// Close implemented as per the poll.Closer interface, waiting for exports in progress.
+func (s *Sink) Close(ctx context.Context) error {
+	return poll.Wait(ctx, &s.exports)
+}
+
+// resourceMetrics returns the metrics of a polled target, and the number of data points in them. Counters are
+// exported as cumulative monotonic sums, histograms as cumulative histograms, and other metrics as gauges. Labels
+// that are resource attributes are not repeated as data point attributes.
+func resourceMetrics(r *poll.Result) (*metricpb.ResourceMetrics, int) {
+	resourceLabels := map[string]bool{"job": true, "instance": true}
+	attrs := map[string]string{
+		"service.name":      "servertech_exporter",
+		"service.version":   version.Version,
+		"servertech.target": r.Target.Name,
+	}
+	for k, v := range r.Target.Labels {
+		attrs[k] = v
+		resourceLabels[k] = true
+	}
+
+	scope := &metricpb.ScopeMetrics{Scope: &commonpb.InstrumentationScope{Name: scopeName, Version: version.Version}}
+	ts := uint64(r.Time.UnixNano())
+	dataPoints := 0
+	for _, mf := range r.Families {
+		if mf.GetName() == "servertech_system_uptime_seconds" && len(mf.GetMetric()) > 0 {
+			for _, l := range mf.GetMetric()[0].GetLabel() {
+				switch l.GetName() {
+				case "firmware":
+					attrs["servertech.pdu.firmware_version"] = l.GetValue()
+				case "nic_serial_number":
+					attrs["servertech.pdu.serial_number"] = l.GetValue()
+				}
+			}
+		}
+
+		m := &metricpb.Metric{Name: mf.GetName(), Description: mf.GetHelp(), Unit: ucumUnits[mf.GetUnit()]}
+		if mf.GetType() == dto.MetricType_HISTOGRAM {
+			h := &metricpb.Histogram{AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE}
+			for _, metric := range mf.GetMetric() {
+				h.DataPoints = append(h.DataPoints, histogramDataPoint(metric, attributes(metric, resourceLabels), ts))
+			}
+			if len(h.DataPoints) == 0 {
+				continue
+			}
+			m.Data = &metricpb.Metric_Histogram{Histogram: h}
+			scope.Metrics = append(scope.Metrics, m)
+			dataPoints += len(h.DataPoints)
+			continue
+		}
+		var points []*metricpb.NumberDataPoint
+		for _, metric := range mf.GetMetric() {
+			p := &metricpb.NumberDataPoint{TimeUnixNano: ts, Attributes: attributes(metric, resourceLabels)}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				p.Value = &metricpb.NumberDataPoint_AsDouble{AsDouble: metric.GetCounter().GetValue()}
+				if created := metric.GetCounter().GetCreatedTimestamp(); created != nil {
+					p.StartTimeUnixNano = uint64(created.AsTime().UnixNano())
+				}
+			case dto.MetricType_GAUGE:
+				p.Value = &metricpb.NumberDataPoint_AsDouble{AsDouble: metric.GetGauge().GetValue()}
+			case dto.MetricType_UNTYPED:
+				p.Value = &metricpb.NumberDataPoint_AsDouble{AsDouble: metric.GetUntyped().GetValue()}
+			default:
+				continue
+			}
+			points = append(points, p)
+		}
+		if len(points) == 0 {
+			continue
+		}
+		if mf.GetType() == dto.MetricType_COUNTER {
+			m.Data = &metricpb.Metric_Sum{Sum: &metricpb.Sum{
+				DataPoints:             points,
+				AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}}
+		} else {
+			m.Data = &metricpb.Metric_Gauge{Gauge: &metricpb.Gauge{DataPoints: points}}
+		}
+		scope.Metrics = append(scope.Metrics, m)
+		dataPoints += len(points)
+	}
+
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	resource := &resourcepb.Resource{}
+	for _, k := range keys {
+		resource.Attributes = append(resource.Attributes, stringAttr(k, attrs[k]))
+	}
+	return &metricpb.ResourceMetrics{Resource: resource, ScopeMetrics: []*metricpb.ScopeMetrics{scope}}, dataPoints
+}
+
+// attributes returns the labels of a metric that are not resource attributes as data point attributes.
+func attributes(metric *dto.Metric, resourceLabels map[string]bool) []*commonpb.KeyValue {
+	var attrs []*commonpb.KeyValue
+	for _, l := range metric.GetLabel() {
+		if !resourceLabels[l.GetName()] {
+			attrs = append(attrs, stringAttr(l.GetName(), l.GetValue()))
+		}
+	}
+	return attrs
+}
+
+// histogramDataPoint returns a Prometheus histogram as an OTLP histogram data point. Prometheus bucket counts are
+// cumulative, while OTLP bucket counts are of the values between adjacent bounds.
+func histogramDataPoint(metric *dto.Metric, attrs []*commonpb.KeyValue, ts uint64) *metricpb.HistogramDataPoint {
+	h := metric.GetHistogram()
+	sum := h.GetSampleSum()
+	p := &metricpb.HistogramDataPoint{TimeUnixNano: ts, Attributes: attrs, Count: h.GetSampleCount(), Sum: &sum}
+	if created := h.GetCreatedTimestamp(); created != nil {
+		p.StartTimeUnixNano = uint64(created.AsTime().UnixNano())
+	}
+	var previous uint64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			break
+		}
+		p.ExplicitBounds = append(p.ExplicitBounds, b.GetUpperBound())
+		p.BucketCounts = append(p.BucketCounts, b.GetCumulativeCount()-previous)
+		previous = b.GetCumulativeCount()
+	}
+	p.BucketCounts = append(p.BucketCounts, h.GetSampleCount()-previous)
+	return p
+}
+
+func stringAttr(k, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+}
@@ -0,0 +1,58 @@
+package otlp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/config"
+	"github.com/tynany/servertech_exporter/poll"
+)
+
+// constCollector collects a single gauge of each of its descriptors.
+type constCollector []*prometheus.Desc
+
+func (c constCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c {
+		ch <- d
+	}
+}
+
+func (c constCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, d := range c {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, 1)
+	}
+}
+
+func TestResourceMetricsUnits(t *testing.T) {
+	desc := func(name, unit string) *prometheus.Desc {
+		return prometheus.V2.NewDesc(name, "help", prometheus.UnconstrainedLabels(nil), nil, prometheus.WithUnit(unit))
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(constCollector{
+		desc("servertech_outlets_amperes", "amperes"),
+		desc("servertech_cords_voltamps", "voltamps"),
+		desc("servertech_outlets_watts_capacity", ""),
+	})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rm, _ := resourceMetrics(&poll.Result{Target: &config.Target{Name: "pdu1"}, Time: time.Now(), Families: families})
+	units := make(map[string]string)
+	for _, m := range rm.GetScopeMetrics()[0].GetMetrics() {
+		units[m.GetName()] = m.GetUnit()
+	}
+	for name, expected := range map[string]string{
+		"servertech_outlets_amperes":        "A",
+		"servertech_cords_voltamps":         "VA",
+		"servertech_outlets_watts_capacity": "",
+	} {
+		if unit, ok := units[name]; !ok {
+			t.Errorf("%s: not exported", name)
+		} else if unit != expected {
+			t.Errorf("%s: expected unit %q, got %q", name, expected, unit)
+		}
+	}
+}
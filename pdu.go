@@ -0,0 +1,222 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tynany/servertech_exporter/collector"
+)
+
+// pduRefreshSeconds is how often the outlet map page reloads.
+const pduRefreshSeconds = 30
+
+var pduTemplate = template.Must(template.New("pdu").Funcs(template.FuncMap{
+	"statuses": func(statuses map[string]string) string {
+		types := make([]string, 0, len(statuses))
+		for t := range statuses {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for i, t := range types {
+			types[i] = t + ": " + statuses[t]
+		}
+		return strings.Join(types, ", ")
+	},
+}).Parse(`<html>
+	<head>
+	<title>{{.Target}} - ServerTech Exporter</title>
+	<meta http-equiv="refresh" content="{{.Refresh}}">
+	<style>
+	body { font-family: sans-serif; }
+	.unit, .cord { border: 1px solid #ccc; margin: 8px 0; padding: 4px 12px; }
+	.branch { display: inline-block; vertical-align: top; border: 1px solid #ddd; margin: 4px; padding: 4px 8px; }
+	.outlet { display: inline-block; width: 140px; margin: 3px; padding: 4px; border-radius: 4px; font-size: small; }
+	.normal { background: #cfc; }
+	.off { background: #ddd; }
+	.alarm { background: #f99; }
+	.unknown { background: #fff; border: 1px dashed #aaa; }
+	.bar { display: inline-block; width: 200px; height: 10px; border: 1px solid #888; vertical-align: middle; }
+	.bar span { display: block; height: 100%; background: #4a4; }
+	.bar span.high { background: #d33; }
+	.error { color: #c00; }
+	</style>
+	</head>
+	<body>
+	<h1>{{.Target}}</h1>
+	<p><a href="/">Status</a> &middot; {{.Time.Format "2006-01-02 15:04:05 MST"}} &middot;
+	<span class="outlet normal">on</span> <span class="outlet off">off</span> <span class="outlet alarm">not normal</span> <span class="outlet unknown">no readings</span></p>
+	{{range $subsystem, $err := .Errors}}<p class="error">Cannot read {{$subsystem}}: {{$err}}</p>{{end}}
+	{{range .Units}}
+	<div class="unit">
+	<h2>Unit {{.ID}}{{with .Name}}: {{.}}{{end}}</h2>
+	{{range .Cords}}
+	<div class="cord">
+	<h3>Cord {{.ID}}{{with .Name}}: {{.}}{{end}}{{with .PlugType}} ({{.}}){{end}}</h3>
+	{{range .Phases}}<div>Phase {{template "load" .}}</div>{{end}}
+	{{range .Branches}}
+	<div class="branch">
+	<div>Branch {{template "load" .Load}}</div>
+	{{range .Outlets}}{{template "outlet" .}}{{end}}
+	</div>
+	{{end}}
+	{{if .Outlets}}<div class="branch"><div>No branch</div>{{range .Outlets}}{{template "outlet" .}}{{end}}</div>{{end}}
+	</div>
+	{{end}}
+	</div>
+	{{end}}
+	</body>
+	</html>
+{{define "load"}}{{.ID}}{{with .Name}} {{.}}{{end}}: {{printf "%.1f" .Amps}} A
+{{- if .Capacity}} of {{printf "%.0f" .Capacity}} A <span class="bar"><span class="{{if ge .Percent 80.0}}high{{end}}" style="width: {{printf "%.0f" .Percent}}%"></span></span>{{end}}{{end}}
+{{define "outlet"}}<div class="outlet {{.Class}}" title="{{statuses .Statuses}}"><b>{{.ID}}</b> {{.Name}}<br>
+{{- with .Host}}{{.}}<br>{{end}}
+{{- if .Readings}}{{.State}} {{printf "%.2f" .Amps}} A{{else}}-{{end}}</div>{{end}}
+`))
+
+// pduLoad is the current of a phase or branch, and its capacity if known.
+type pduLoad struct {
+	ID, Name       string
+	Amps, Capacity float64
+	Percent        float64
+}
+
+type pduBranch struct {
+	Load    pduLoad
+	Outlets []pduOutlet
+}
+
+type pduOutlet struct {
+	ID, Name, Host, State string
+	Amps                  float64
+	Statuses              map[string]string
+	// Readings is whether the outlet has readings.
+	Readings bool
+	// Class is the CSS class of the outlet's state and statuses.
+	Class string
+}
+
+type pduCord struct {
+	ID, Name, PlugType string
+	Phases             []pduLoad
+	Branches           []pduBranch
+	Outlets            []pduOutlet
+}
+
+type pduUnit struct {
+	ID, Name string
+	Cords    []pduCord
+}
+
+// pduHandler returns a page of the outlets of a PDU, laid out by unit, cord and branch, with their state, current
+// and status, and the load of the phases and branches.
+func pduHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := resolveTarget(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// The topology and the readings shown on it are from the same requests. All outlets are read, not only those kept
+	// by the module, so every outlet in the topology has readings.
+	readings := collector.GetTopologyReadings(requestLogger(r), t.target, t.user, t.pass)
+	topology, err := readings.Topology()
+	if err != nil {
+		requestLogger(r).Error("topology failed", "target", t.target, "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	data := struct {
+		Target  string
+		Refresh int
+		Time    time.Time
+		Errors  map[string]string
+		Units   []pduUnit
+	}{Target: t.target, Refresh: pduRefreshSeconds, Time: readings.Time, Errors: readings.Errors, Units: pduUnits(topology, readings)}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pduTemplate.Execute(w, data); err != nil {
+		requestLogger(r).Error("cannot write pdu page", "target", t.target, "err", err)
+	}
+}
+
+// pduUnits returns the units of a topology with the readings of their phases, branches and outlets. Phases have no
+// capacity of their own, so their load is against the capacity of the input line they are measured from.
+func pduUnits(topology *collector.Topology, readings *collector.Readings) []pduUnit {
+	lines := make(map[string]collector.LineReadings, len(readings.Lines))
+	for _, l := range readings.Lines {
+		lines[l.ID] = l
+	}
+	phases := make(map[string]collector.PhaseReadings, len(readings.Phases))
+	for _, p := range readings.Phases {
+		phases[p.ID] = p
+	}
+	branches := make(map[string]collector.BranchReadings, len(readings.Branches))
+	for _, b := range readings.Branches {
+		branches[b.ID] = b
+	}
+	outlets := make(map[string]collector.OutletReadings, len(readings.Outlets))
+	for _, o := range readings.Outlets {
+		outlets[o.ID] = o
+	}
+	outletList := func(topologyOutlets []collector.TopologyOutlet) []pduOutlet {
+		list := make([]pduOutlet, 0, len(topologyOutlets))
+		for _, to := range topologyOutlets {
+			o := pduOutlet{ID: to.ID, Name: to.Name, Class: "unknown"}
+			if or, ok := outlets[to.ID]; ok {
+				o.Host, o.State, o.Amps, o.Statuses, o.Readings = or.Host, or.State, or.CurrentAmperes, or.Statuses, true
+				o.Class = statusClass(or.State, or.Statuses)
+			}
+			list = append(list, o)
+		}
+		return list
+	}
+
+	units := make([]pduUnit, 0, len(topology.Units))
+	for _, tu := range topology.Units {
+		u := pduUnit{ID: tu.ID, Name: tu.Name}
+		for _, tc := range tu.Cords {
+			c := pduCord{ID: tc.ID, Name: tc.Name, PlugType: tc.PlugType, Outlets: outletList(tc.Outlets)}
+			for _, tp := range tc.Phases {
+				c.Phases = append(c.Phases, newLoad(tp.ID, tp.Name, phases[tp.ID].CurrentAmperes, lines[collector.PhaseLineID(tp.ID)].CurrentCapacityAmperes))
+			}
+			for _, tb := range tc.Branches {
+				b := branches[tb.ID]
+				c.Branches = append(c.Branches, pduBranch{
+					Load:    newLoad(tb.ID, tb.Name, b.CurrentAmperes, b.CurrentCapacityAmperes),
+					Outlets: outletList(tb.Outlets),
+				})
+			}
+			u.Cords = append(u.Cords, c)
+		}
+		units = append(units, u)
+	}
+	return units
+}
+
+func newLoad(id, name string, amps, capacity float64) pduLoad {
+	l := pduLoad{ID: id, Name: name, Amps: amps, Capacity: capacity}
+	if capacity > 0 {
+		l.Percent = amps / capacity * 100
+		if l.Percent > 100 {
+			l.Percent = 100
+		}
+	}
+	return l
+}
+
+// statusClass returns the CSS class of an outlet: alarm if any status is not normal, otherwise off or normal by
+// state.
+func statusClass(state string, statuses map[string]string) string {
+	for _, s := range statuses {
+		if s != "normal" {
+			return "alarm"
+		}
+	}
+	if state == "off" {
+		return "off"
+	}
+	return "normal"
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// pduFixture is the JAWS monitor API of a single cord PDU with two branches, by path.
+var pduFixture = map[string]string{
+	"/jaws/monitor/units":  `[{"id": "A", "name": "Master", "type": "master"}]`,
+	"/jaws/monitor/cords":  `[{"id": "AA", "name": "Cord A", "plug_type": "IEC 60309"}]`,
+	"/jaws/monitor/lines":  `[{"id": "AA:L1", "current": 12, "current_capacity": 32}, {"id": "AA:L2", "current": 4, "current_capacity": 32}]`,
+	"/jaws/monitor/phases": `[{"id": "AA:L1-L2", "current": 8}]`,
+	"/jaws/monitor/ocps":   `[{"id": "AA:CB1", "type": "breaker", "current_capacity": 20}, {"id": "AA:CB2", "type": "breaker", "current_capacity": 20}]`,
+	"/jaws/monitor/branches": `[
+		{"id": "AA:BR1", "current": 5, "current_capacity": 20, "ocp_id": "AA:CB1", "phase_id": "AA:L1-L2"},
+		{"id": "AA:BR2", "current": 3, "current_capacity": 20, "ocp_id": "AA:CB2", "phase_id": "AA:L1-L2"}
+	]`,
+	"/jaws/monitor/outlets": `[
+		{"id": "AA1", "name": "web1", "branch_id": "AA:BR1", "state": "on"},
+		{"id": "AA2", "name": "web2", "branch_id": "AA:BR2", "state": "off"},
+		{"id": "AA3", "name": "db1", "branch_id": "AA:BR2", "state": "on", "current": 1.5}
+	]`,
+}
+
+func TestPDUHandler(t *testing.T) {
+	jaws := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := pduFixture[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer jaws.Close()
+	target := jaws.Listener.Addr().String()
+	useConfig(t, "targets:\n  - name: "+target+"\n    user: admn\n    password: s3cret\n")
+
+	rec := httptest.NewRecorder()
+	pduHandler(rec, httptest.NewRequest(http.MethodGet, "/ui/pdu?target="+target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	page := rec.Body.String()
+
+	// Phases are loaded against the capacity of the line they are measured from.
+	if expected := "Phase AA:L1-L2: 8.0 A of 32 A"; !strings.Contains(page, expected) {
+		t.Errorf("expected page to contain %q", expected)
+	}
+	if strings.Contains(page, "No branch") {
+		t.Error("expected every outlet to be placed in its branch")
+	}
+
+	// Each branch is followed by its outlets, up to the next branch.
+	branches := strings.Split(page, `<div class="branch">`)[1:]
+	if len(branches) != 2 {
+		t.Fatalf("expected 2 branches, got %d", len(branches))
+	}
+	for i, test := range []struct {
+		branch  string
+		outlets []string
+	}{
+		{"Branch AA:BR1: 5.0 A of 20 A", []string{"<b>AA1</b> web1"}},
+		{"Branch AA:BR2: 3.0 A of 20 A", []string{"<b>AA2</b> web2", "<b>AA3</b> db1"}},
+	} {
+		if !strings.Contains(branches[i], test.branch) {
+			t.Errorf("branch %d: expected %q, got %q", i, test.branch, branches[i])
+		}
+		if n := strings.Count(branches[i], `<div class="outlet `); n != len(test.outlets) {
+			t.Errorf("branch %d: expected %d outlets, got %d", i, len(test.outlets), n)
+		}
+		for _, outlet := range test.outlets {
+			if !strings.Contains(branches[i], outlet) {
+				t.Errorf("branch %d: expected outlet %q", i, outlet)
+			}
+		}
+	}
+	if expected := `<div class="outlet off" title=""><b>AA2</b>`; !strings.Contains(page, expected) {
+		t.Errorf("expected page to contain %q", expected)
+	}
+}
@@ -0,0 +1,170 @@
+// Package poll scrapes the named targets of the configuration file in the background, and writes the results to
+// sinks, for when the exporter cannot be scraped by Prometheus.
+package poll
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tynany/servertech_exporter/collector"
+	"github.com/tynany/servertech_exporter/config"
+)
+
+var (
+	interval = kingpin.Flag("poll.interval", "Interval at which the named targets of the configuration file are polled in the background and written to the enabled outputs. Background polling is disabled if 0.").Default("0s").Duration()
+	job      = kingpin.Flag("poll.job", "Value of the job label added to background polled metrics.").Default("servertech").String()
+
+	polled atomic.Bool
+)
+
+// Result is the metrics of a single poll of a target.
+type Result struct {
+	Target *config.Target
+	// Time the target was polled.
+	Time     time.Time
+	Families []*dto.MetricFamily
+	// Readings of the target, which its metrics are derived from.
+	Readings *collector.Readings
+}
+
+// Sink is an output background polled metrics are written to.
+type Sink interface {
+	// Write is called with the results of all targets after each poll, and must not block the next poll.
+	Write(results []*Result)
+}
+
+// Closer is a Sink that writes in the background or keeps state, which must be flushed before the exporter exits.
+type Closer interface {
+	Sink
+	// Close flushes the writes in progress and any state of the sink, giving up when ctx is done.
+	Close(ctx context.Context) error
+}
+
+// Enabled returns whether background polling is enabled.
+func Enabled() bool {
+	return *interval > 0
+}
+
+// Polled returns whether the first poll has been written to the sinks.
+func Polled() bool {
+	return polled.Load()
+}
+
+// Run polls the named targets of the configuration returned by cfg every poll interval, and writes the results to
+// sinks. It returns once ctx is done, after writing the poll in progress.
+func Run(ctx context.Context, cfg func() *config.Config, sinks ...Sink) {
+	slog.Info("background polling enabled", "interval", *interval, "sinks", len(sinks))
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		results := pollTargets(cfg())
+		for _, sink := range sinks {
+			sink.Write(results)
+		}
+		polled.Store(true)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the sinks that are Closers, giving up when ctx is done.
+func Close(ctx context.Context, sinks ...Sink) {
+	for _, sink := range sinks {
+		if c, ok := sink.(Closer); ok {
+			if err := c.Close(ctx); err != nil {
+				slog.Error("cannot close output", "sink", fmt.Sprintf("%T", sink), "err", err)
+			}
+		}
+	}
+}
+
+// Wait waits for wg, or returns the error of ctx if it is done first.
+func Wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func pollTargets(cfg *config.Config) []*Result {
+	if cfg == nil {
+		return nil
+	}
+	var targets []*config.Target
+	for _, t := range cfg.Targets {
+		if t.Name != "" {
+			targets = append(targets, t)
+		}
+	}
+
+	results := make([]*Result, len(targets))
+	wg := &sync.WaitGroup{}
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *config.Target) {
+			defer wg.Done()
+			results[i] = pollTarget(cfg, t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	polled := results[:0]
+	for _, r := range results {
+		if r != nil {
+			polled = append(polled, r)
+		}
+	}
+	return polled
+}
+
+// pollTarget reads a target once, and returns its readings and the metrics derived from them.
+func pollTarget(cfg *config.Config, t *config.Target) *Result {
+	module, err := cfg.Module("", t.Name)
+	if err != nil {
+		slog.Error("cannot poll target", "target", t.Name, "err", err)
+		return nil
+	}
+	user, pass, err := cfg.Credentials(t.Name)
+	if err != nil {
+		slog.Error("cannot poll target", "target", t.Name, "err", err)
+		return nil
+	}
+
+	// Labels Prometheus would add when scraping the target, overridden by the target's labels.
+	labels := prometheus.Labels{"job": *job, "instance": t.Name}
+	for k, v := range t.Labels {
+		labels[k] = v
+	}
+
+	r := &Result{Target: t, Time: time.Now(), Readings: collector.GetReadings(nil, t.Name, user, pass, module)}
+	exporter := collector.NewExporter(t.Name, user, pass, module)
+	exporter.Readings = r.Readings
+	registry := prometheus.NewRegistry()
+	if err := prometheus.WrapRegistererWith(labels, registry).Register(exporter); err != nil {
+		slog.Error("cannot poll target", "target", t.Name, "err", err)
+		return nil
+	}
+	r.Families, err = registry.Gather()
+	if err != nil {
+		slog.Error("cannot gather polled metrics", "target", t.Name, "err", err)
+	}
+	return r
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tynany/servertech_exporter/config"
+)
+
+var (
+	// activeConfig is the loaded configuration file, nil if none is specified. It is replaced as a whole on reload,
+	// so requests use the configuration that was active when they started.
+	activeConfig atomic.Pointer[config.Config]
+	reloadMu     sync.Mutex
+
+	configReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "servertech_config_last_reload_successful",
+		Help: "Whether the last configuration file reload attempt was successful.",
+	})
+	configReloadSuccessTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "servertech_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration file reload.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configReloadSuccessful, configReloadSuccessTime)
+}
+
+// reloadConfig loads the configuration file and makes it active. The active configuration is kept if the file
+// cannot be loaded.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if *configFile != "" {
+		c, err := config.Load(*configFile)
+		if err != nil {
+			configReloadSuccessful.Set(0)
+			return err
+		}
+		activeConfig.Store(c)
+	}
+	configReloadSuccessful.Set(1)
+	configReloadSuccessTime.Set(float64(time.Now().Unix()))
+	return nil
+}
+
+// reloadOnSignal reloads the configuration file whenever a SIGHUP is received.
+func reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloadConfig(); err != nil {
+			slog.Error("cannot reload config", "err", err)
+			continue
+		}
+		slog.Info("reloaded config", "file", *configFile)
+	}
+}
+
+// reloadHandler reloads the configuration file on POST requests.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reloadConfig(); err != nil {
+		slog.Error("cannot reload config", "err", err)
+		http.Error(w, "cannot reload config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("reloaded config", "file", *configFile)
+	w.Write([]byte("config reloaded\n"))
+}
@@ -0,0 +1,169 @@
+package remotewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// batch is a snappy compressed WriteRequest waiting to be sent.
+type batch struct {
+	// Time the samples in the batch were polled.
+	time    time.Time
+	samples int
+	data    []byte
+	// Path of the file the batch is stored in, if the queue is stored on disk.
+	path string
+}
+
+// queue is a FIFO queue of batches, optionally stored in a directory so they survive restarts. Each batch is stored
+// in a file named <poll time in unix nanoseconds>-<sequence>-<samples>.snappy.
+type queue struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	dir        string
+	maxBatches int
+	seq        int
+	batches    []*batch
+}
+
+func newQueue(dir string, maxBatches int) (*queue, error) {
+	if maxBatches < 1 {
+		return nil, fmt.Errorf("--remote-write.queue-max-batches must be at least 1")
+	}
+	q := &queue{dir: dir, maxBatches: maxBatches}
+	q.cond = sync.NewCond(&q.mu)
+	if dir == "" {
+		return q, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create remote_write queue directory: %v", err)
+	}
+	// Temporary files are left by writes interrupted before being renamed into place, so hold incomplete batches.
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmp := range tmps {
+		if err := os.Remove(tmp); err != nil {
+			return nil, fmt.Errorf("cannot remove incomplete remote_write batch: %v", err)
+		}
+		slog.Warn("removed incomplete remote_write batch", "path", tmp)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.snappy"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		var nanos int64
+		var seq, samples int
+		if _, err := fmt.Sscanf(filepath.Base(path), "%d-%d-%d.snappy", &nanos, &seq, &samples); err != nil {
+			slog.Error("ignoring unknown file in remote_write queue directory", "path", path)
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read queued remote_write batch: %v", err)
+		}
+		q.batches = append(q.batches, &batch{time: time.Unix(0, nanos), samples: samples, data: data, path: path})
+		pendingSamples.Add(float64(samples))
+		if seq >= q.seq {
+			q.seq = seq + 1
+		}
+	}
+	if len(q.batches) > 0 {
+		slog.Info("loaded queued remote_write batches", "batches", len(q.batches))
+	}
+	for len(q.batches) > maxBatches {
+		q.drop()
+	}
+	return q, nil
+}
+
+// push adds b to the end of the queue, dropping the oldest batch if the queue is full.
+func (q *queue) push(b *batch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.dir != "" {
+		// Zero padding keeps the files in queue order when sorted by name.
+		b.path = filepath.Join(q.dir, fmt.Sprintf("%020d-%010d-%d.snappy", b.time.UnixNano(), q.seq, b.samples))
+		if err := writeFile(b.path, b.data); err != nil {
+			slog.Error("cannot store remote_write batch, queueing it in memory", "err", err)
+			b.path = ""
+		}
+	}
+	q.seq++
+
+	if len(q.batches) >= q.maxBatches {
+		q.drop()
+	}
+	q.batches = append(q.batches, b)
+	pendingSamples.Add(float64(b.samples))
+	q.cond.Signal()
+}
+
+// peek returns the batch at the front of the queue, waiting for one to be pushed if the queue is empty.
+func (q *queue) peek() *batch {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.batches) == 0 {
+		q.cond.Wait()
+	}
+	return q.batches[0]
+}
+
+// len returns the number of batches in the queue.
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.batches)
+}
+
+// remove removes b from the queue, if it has not already been dropped.
+func (q *queue) remove(b *batch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, queued := range q.batches {
+		if queued == b {
+			q.batches = append(q.batches[:i], q.batches[i+1:]...)
+			q.delete(b)
+			return
+		}
+	}
+}
+
+// drop removes the oldest batch from the queue, counting its samples as dropped. q.mu must be held.
+func (q *queue) drop() {
+	b := q.batches[0]
+	q.batches = q.batches[1:]
+	q.delete(b)
+	samplesDropped.WithLabelValues("queue_full").Add(float64(b.samples))
+	slog.Error("remote_write queue full, dropped oldest batch", "samples", b.samples)
+}
+
+// delete deletes the file b is stored in. q.mu must be held.
+func (q *queue) delete(b *batch) {
+	pendingSamples.Sub(float64(b.samples))
+	if b.path != "" {
+		if err := os.Remove(b.path); err != nil {
+			slog.Error("cannot delete remote_write batch file", "err", err)
+		}
+	}
+}
+
+// writeFile writes data to path atomically, so a partially written batch is never loaded.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
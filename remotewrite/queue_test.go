@@ -0,0 +1,80 @@
+package remotewrite
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewQueueLoadsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"00000000000000002000-0000000003-20.snappy":     "second",
+		"00000000000000001000-0000000002-10.snappy":     "first",
+		"00000000000000003000-0000000004-30.snappy.tmp": "incomplete",
+		"unknown.snappy": "unknown",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q, err := newQueue(dir, 10)
+	if err != nil {
+		t.Fatalf("cannot load queue: %v", err)
+	}
+	var loaded []batch
+	for _, b := range q.batches {
+		loaded = append(loaded, *b)
+	}
+	expected := []batch{
+		{time: time.Unix(0, 1000), samples: 10, data: []byte("first"), path: filepath.Join(dir, "00000000000000001000-0000000002-10.snappy")},
+		{time: time.Unix(0, 2000), samples: 20, data: []byte("second"), path: filepath.Join(dir, "00000000000000002000-0000000003-20.snappy")},
+	}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Errorf("expected batches %v, got %v", expected, loaded)
+	}
+	if q.seq != 4 {
+		t.Errorf("expected sequence 4, got %d", q.seq)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00000000000000003000-0000000004-30.snappy.tmp")); !os.IsNotExist(err) {
+		t.Errorf("expected incomplete batch to be removed, got %v", err)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newQueue(dir, 2)
+	if err != nil {
+		t.Fatalf("cannot create queue: %v", err)
+	}
+	var batches []*batch
+	for i := 1; i <= 3; i++ {
+		b := &batch{time: time.Unix(int64(i), 0), samples: i, data: []byte{byte(i)}}
+		batches = append(batches, b)
+		q.push(b)
+	}
+
+	// The oldest batch is dropped when the queue is full.
+	if _, err := os.Stat(batches[0].path); !os.IsNotExist(err) {
+		t.Errorf("expected dropped batch file to be removed, got %v", err)
+	}
+	if b := q.peek(); b != batches[1] {
+		t.Errorf("expected second batch at the front, got %v", b)
+	}
+	q.remove(batches[1])
+	if q.len() != 1 || q.peek() != batches[2] {
+		t.Errorf("expected only the third batch in the queue, got %d batches", q.len())
+	}
+
+	// Batches still queued are loaded by the next queue.
+	reloaded, err := newQueue(dir, 2)
+	if err != nil {
+		t.Fatalf("cannot load queue: %v", err)
+	}
+	if reloaded.len() != 1 || reloaded.peek().samples != 3 || reloaded.seq != 3 {
+		t.Errorf("expected the third batch to be loaded, got %d batches", reloaded.len())
+	}
+}
@@ -0,0 +1,321 @@
+// Package remotewrite pushes background polled metrics to a Prometheus remote_write endpoint.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"github.com/tynany/servertech_exporter/poll"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+var (
+	url             = kingpin.Flag("remote-write.url", "URL of the Prometheus remote_write endpoint background polled metrics are pushed to.").String()
+	username        = kingpin.Flag("remote-write.username", "Username for basic authentication to the remote_write endpoint.").String()
+	passwordFile    = kingpin.Flag("remote-write.password-file", "Path to a file containing the password for basic authentication to the remote_write endpoint.").String()
+	bearerTokenFile = kingpin.Flag("remote-write.bearer-token-file", "Path to a file containing the bearer token for authentication to the remote_write endpoint.").String()
+	timeout         = kingpin.Flag("remote-write.timeout", "Timeout of requests to the remote_write endpoint.").Default("30s").Duration()
+	batchSize       = kingpin.Flag("remote-write.batch-size", "Maximum number of samples sent in a single request to the remote_write endpoint.").Default("2000").Int()
+	queueDir        = kingpin.Flag("remote-write.queue-dir", "Directory batches waiting to be sent are stored in, so they survive restarts. Batches are only queued in memory if not specified.").String()
+	queueMaxBatches = kingpin.Flag("remote-write.queue-max-batches", "Maximum number of batches waiting to be sent. The oldest batch is dropped when the queue is full.").Default("1000").Int()
+
+	samplesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "servertech_remote_write_samples_sent_total",
+		Help: "Total number of samples successfully pushed to the remote_write endpoint.",
+	})
+	samplesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "servertech_remote_write_samples_dropped_total",
+		Help: "Total number of samples dropped without being pushed to the remote_write endpoint, by reason (queue_full = dropped as the oldest batch of a full queue, rejected = rejected by the endpoint).",
+	}, []string{"reason"})
+	pushFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "servertech_remote_write_failures_total",
+		Help: "Total number of failed requests to the remote_write endpoint.",
+	})
+	pushLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "servertech_remote_write_lag_seconds",
+		Help: "Seconds between the poll and the successful push of the most recently pushed batch.",
+	})
+	pendingSamples = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "servertech_remote_write_pending_samples",
+		Help: "Number of samples queued waiting to be pushed to the remote_write endpoint.",
+	})
+)
+
+func init() {
+	samplesDropped.WithLabelValues("queue_full")
+	samplesDropped.WithLabelValues("rejected")
+	prometheus.MustRegister(samplesSent, samplesDropped, pushFailures, pushLag, pendingSamples)
+}
+
+// Enabled returns whether pushing to a remote_write endpoint is configured.
+func Enabled() bool {
+	return *url != ""
+}
+
+// Sink pushes background polled metrics to a remote_write endpoint, implemented as per the poll.Sink interface.
+type Sink struct {
+	client *http.Client
+	queue  *queue
+}
+
+// New returns a new Sink, and starts sending the batches it queues.
+func New() (*Sink, error) {
+	if *batchSize < 1 {
+		return nil, fmt.Errorf("--remote-write.batch-size must be at least 1")
+	}
+	if *username != "" && *bearerTokenFile != "" {
+		return nil, fmt.Errorf("at most one of --remote-write.username and --remote-write.bearer-token-file may be specified")
+	}
+	// Check the credentials can be read before polling starts, they are re-read on every request.
+	if _, err := authorization(); err != nil {
+		return nil, err
+	}
+	q, err := newQueue(*queueDir, *queueMaxBatches)
+	if err != nil {
+		return nil, err
+	}
+	s := &Sink{client: &http.Client{Timeout: *timeout}, queue: q}
+	go s.send()
+	return s, nil
+}
+
+// Write implemented as per the poll.Sink interface.
+func (s *Sink) Write(results []*poll.Result) {
+	for _, r := range results {
+		ts := toTimeSeries(r)
+		for len(ts) > 0 {
+			var b []timeSeries
+			samples := 0
+			for len(ts) > 0 && (samples == 0 || samples+len(ts[0].samples) <= *batchSize) {
+				samples += len(ts[0].samples)
+				b, ts = append(b, ts[0]), ts[1:]
+			}
+			s.queue.push(&batch{time: r.Time, samples: samples, data: snappy.Encode(nil, encodeWriteRequest(b))})
+		}
+	}
+}
+
+// Close implemented as per the poll.Closer interface, sending the queued batches until ctx is done. Batches not sent
+// are kept in the queue directory, if specified, and sent after a restart.
+func (s *Sink) Close(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for s.queue.len() > 0 {
+		select {
+		case <-ctx.Done():
+			if s.queue.dir != "" {
+				return fmt.Errorf("%d batches not sent, kept in the queue directory", s.queue.len())
+			}
+			return fmt.Errorf("%d batches not sent and lost, as --remote-write.queue-dir is not specified", s.queue.len())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// send sends queued batches in order, retrying with backoff while the endpoint is unavailable.
+func (s *Sink) send() {
+	backoff := minBackoff
+	for {
+		b := s.queue.peek()
+		err := s.push(b.data)
+		switch {
+		case err == nil:
+			samplesSent.Add(float64(b.samples))
+			pushLag.Set(time.Since(b.time).Seconds())
+			s.queue.remove(b)
+			backoff = minBackoff
+		case !isRecoverable(err):
+			slog.Error("remote_write endpoint rejected batch", "samples", b.samples, "err", err)
+			samplesDropped.WithLabelValues("rejected").Add(float64(b.samples))
+			s.queue.remove(b)
+		default:
+			slog.Error("cannot push to remote_write endpoint", "retry_in", backoff, "err", err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, maxBackoff)
+		}
+	}
+}
+
+// httpError is an unsuccessful HTTP response from the remote_write endpoint.
+type httpError struct {
+	code int
+	body string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("incorrect status code received from endpoint: %d: %s", e.code, e.body)
+}
+
+// isRecoverable returns whether a push that failed with err may succeed if retried.
+func isRecoverable(err error) bool {
+	if e, ok := err.(*httpError); ok {
+		return e.code >= 500 || e.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+func (s *Sink) push(data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, *url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "servertech_exporter/"+version.Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	auth, err := authorization()
+	if err != nil {
+		return err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		pushFailures.Inc()
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		pushFailures.Inc()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return &httpError{code: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// authorization returns the value of the Authorization header of requests to the remote_write endpoint.
+func authorization() (string, error) {
+	switch {
+	case *bearerTokenFile != "":
+		token, err := ioutil.ReadFile(*bearerTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("cannot read remote_write bearer token file: %v", err)
+		}
+		return "Bearer " + strings.TrimSpace(string(token)), nil
+	case *username != "":
+		var password []byte
+		if *passwordFile != "" {
+			var err error
+			if password, err = ioutil.ReadFile(*passwordFile); err != nil {
+				return "", fmt.Errorf("cannot read remote_write password file: %v", err)
+			}
+		}
+		req := &http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(*username, strings.TrimSpace(string(password)))
+		return req.Header.Get("Authorization"), nil
+	}
+	return "", nil
+}
+
+type label struct {
+	name, value string
+}
+
+type sample struct {
+	value     float64
+	timestamp int64
+}
+
+type timeSeries struct {
+	labels  []label
+	samples []sample
+}
+
+// toTimeSeries returns the time series of the polled metrics, timestamped with the poll time.
+func toTimeSeries(r *poll.Result) []timeSeries {
+	ts := r.Time.UnixMilli()
+	var series []timeSeries
+	add := func(name string, m *dto.Metric, value float64, extra ...label) {
+		labels := []label{{"__name__", name}}
+		for _, l := range m.GetLabel() {
+			labels = append(labels, label{l.GetName(), l.GetValue()})
+		}
+		labels = append(labels, extra...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+		series = append(series, timeSeries{labels: labels, samples: []sample{{value, ts}}})
+	}
+
+	for _, mf := range r.Families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					add(name, m, q.GetValue(), label{"quantile", fmt.Sprint(q.GetQuantile())})
+				}
+				add(name+"_sum", m, m.GetSummary().GetSampleSum())
+				add(name+"_count", m, float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				hasInf := false
+				for _, b := range m.GetHistogram().GetBucket() {
+					hasInf = hasInf || math.IsInf(b.GetUpperBound(), 1)
+					add(name+"_bucket", m, float64(b.GetCumulativeCount()), label{"le", fmt.Sprint(b.GetUpperBound())})
+				}
+				if !hasInf {
+					add(name+"_bucket", m, float64(m.GetHistogram().GetSampleCount()), label{"le", "+Inf"})
+				}
+				add(name+"_sum", m, m.GetHistogram().GetSampleSum())
+				add(name+"_count", m, float64(m.GetHistogram().GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// encodeWriteRequest returns the series encoded as a remote_write protobuf WriteRequest.
+func encodeWriteRequest(series []timeSeries) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, lb)
+		}
+		for _, smp := range s.samples {
+			var sb []byte
+			sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+			sb = protowire.AppendFixed64(sb, math.Float64bits(smp.value))
+			sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+			sb = protowire.AppendVarint(sb, uint64(smp.timestamp))
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, sb)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
@@ -0,0 +1,173 @@
+package remotewrite
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/tynany/servertech_exporter/poll"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// decodeWriteRequest decodes a remote_write protobuf WriteRequest, failing on fields the exporter does not send.
+func decodeWriteRequest(t *testing.T, data []byte) []timeSeries {
+	t.Helper()
+	var series []timeSeries
+	for _, ts := range fields(t, data, 1) {
+		var s timeSeries
+		for num, values := range groupFields(t, ts) {
+			for _, v := range values {
+				switch num {
+				case 1:
+					l := groupFields(t, v)
+					s.labels = append(s.labels, label{string(l[1][0]), string(l[2][0])})
+				case 2:
+					var smp sample
+					for len(v) > 0 {
+						num, typ, n := protowire.ConsumeTag(v)
+						v = v[n:]
+						switch {
+						case num == 1 && typ == protowire.Fixed64Type:
+							bits, n := protowire.ConsumeFixed64(v)
+							smp.value, v = math.Float64frombits(bits), v[n:]
+						case num == 2 && typ == protowire.VarintType:
+							ts, n := protowire.ConsumeVarint(v)
+							smp.timestamp, v = int64(ts), v[n:]
+						default:
+							t.Fatalf("unexpected sample field %d of type %d", num, typ)
+						}
+					}
+					s.samples = append(s.samples, smp)
+				default:
+					t.Fatalf("unexpected time series field %d", num)
+				}
+			}
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+// fields returns the length delimited fields of data, which must all have number num.
+func fields(t *testing.T, data []byte, num protowire.Number) [][]byte {
+	t.Helper()
+	var values [][]byte
+	for n, v := range groupFields(t, data) {
+		if n != num {
+			t.Fatalf("unexpected field %d", n)
+		}
+		values = v
+	}
+	return values
+}
+
+// groupFields returns the length delimited fields of data by field number, in order.
+func groupFields(t *testing.T, data []byte) map[protowire.Number][][]byte {
+	t.Helper()
+	values := make(map[protowire.Number][][]byte)
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 || typ != protowire.BytesType {
+			t.Fatalf("invalid field %d of type %d", num, typ)
+		}
+		v, m := protowire.ConsumeBytes(data[n:])
+		if m < 0 {
+			t.Fatalf("invalid length of field %d", num)
+		}
+		values[num] = append(values[num], v)
+		data = data[n+m:]
+	}
+	return values
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		series []timeSeries
+		// Expected encoding in hex, if checked byte for byte.
+		expected string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "single sample",
+			series: []timeSeries{{labels: []label{{"a", "b"}}, samples: []sample{{1, 1000}}}},
+			// WriteRequest.timeseries (1) { labels (1) { name (1) "a", value (2) "b" },
+			// samples (2) { value (1) 1.0, timestamp (2) 1000 } }
+			expected: "0a16" + "0a06" + "0a0161" + "120162" + "120c" + "09000000000000f03f" + "10e807",
+		},
+		{
+			name: "multiple series",
+			series: []timeSeries{
+				{
+					labels:  []label{{"__name__", "servertech_outlets_watts"}, {"id", "AA1"}, {"instance", "pdu1"}},
+					samples: []sample{{120.5, 1700000000000}},
+				},
+				{
+					labels:  []label{{"__name__", "servertech_up"}, {"name", "ünïcode"}},
+					samples: []sample{{0, 0}, {math.Inf(1), 1}, {-2.5, 2}},
+				},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := encodeWriteRequest(test.series)
+			if test.expected != "" {
+				if got := hex.EncodeToString(data); got != test.expected {
+					t.Errorf("expected %s, got %s", test.expected, got)
+				}
+			}
+			if decoded := decodeWriteRequest(t, data); !reflect.DeepEqual(decoded, test.series) {
+				t.Errorf("expected %v, got %v", test.series, decoded)
+			}
+		})
+	}
+}
+
+func TestToTimeSeries(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	labels := []*dto.LabelPair{{Name: proto.String("instance"), Value: proto.String("pdu1")}}
+	r := &poll.Result{Time: now, Families: []*dto.MetricFamily{
+		{
+			Name:   proto.String("servertech_outlets_watts"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Label: labels, Gauge: &dto.Gauge{Value: proto.Float64(120.5)}}},
+		},
+		{
+			Name:   proto.String("servertech_jaws_requests_total"),
+			Type:   dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{Label: labels, Counter: &dto.Counter{Value: proto.Float64(3)}}},
+		},
+		{
+			Name: proto.String("servertech_jaws_request_duration_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{Label: labels, Histogram: &dto.Histogram{
+				SampleCount: proto.Uint64(3),
+				SampleSum:   proto.Float64(1.5),
+				Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(2)}},
+			}}},
+		},
+	}}
+
+	ms := now.UnixMilli()
+	series := func(name string, value float64) timeSeries {
+		return timeSeries{labels: []label{{"__name__", name}, {"instance", "pdu1"}}, samples: []sample{{value, ms}}}
+	}
+	expected := []timeSeries{
+		series("servertech_outlets_watts", 120.5),
+		series("servertech_jaws_requests_total", 3),
+		// Labels are sorted by name, so le sorts after instance.
+		{labels: []label{{"__name__", "servertech_jaws_request_duration_seconds_bucket"}, {"instance", "pdu1"}, {"le", "0.5"}}, samples: []sample{{2, ms}}},
+		{labels: []label{{"__name__", "servertech_jaws_request_duration_seconds_bucket"}, {"instance", "pdu1"}, {"le", "+Inf"}}, samples: []sample{{3, ms}}},
+		series("servertech_jaws_request_duration_seconds_sum", 1.5),
+		series("servertech_jaws_request_duration_seconds_count", 3),
+	}
+	if got := toTimeSeries(r); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
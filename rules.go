@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/common/model"
+	"github.com/tynany/servertech_exporter/collector"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	rulesCmd               = kingpin.Command("rules", "Print Prometheus recording and alerting rules for the metrics of the enabled collectors, generated from their metric descriptions, and exit.")
+	rulesBranchUtilization = rulesCmd.Flag("branch-utilization", "Ratio of branch current to capacity above which branches are alerted as overloaded. The default is the NEC continuous load limit.").Default("0.8").Float64()
+	rulesLineUtilization   = rulesCmd.Flag("line-utilization", "Ratio of input line current to capacity above which lines are alerted as overloaded.").Default("0.8").Float64()
+	rulesOCPUtilization    = rulesCmd.Flag("ocp-utilization", "Ratio of OCP current to capacity above which OCPs are alerted as overloaded.").Default("0.8").Float64()
+	rulesPhaseImbalance    = rulesCmd.Flag("phase-imbalance", "3 phase out of balance percentage above which cords are alerted as imbalanced.").Default("20").Float64()
+	rulesFor               = rulesCmd.Flag("for", "Duration an alert's condition must hold before it fires.").Default("5m").Duration()
+	rulesSeverity          = rulesCmd.Flag("severity", "Value of the severity label of the alerts.").Default("warning").String()
+	rulesSelector          = rulesCmd.Flag("selector", "Label matchers added to every metric selector, e.g. job=\"servertech\".").String()
+)
+
+// entityNames are the names of the entities of each subsystem, used in alert names and summaries.
+var entityNames = map[string]string{
+	"branches": "Branch",
+	"cords":    "Cord",
+	"lines":    "Line",
+	"ocps":     "OCP",
+	"outlets":  "Outlet",
+	"phases":   "Phase",
+	"system":   "System",
+	"units":    "Unit",
+}
+
+// aggregationLabels are the labels recording rules aggregate by at each level, in addition to the job and instance of
+// the target.
+var aggregationLabels = map[string][]string{
+	"cord": {"unit_id", "cord_id"},
+	"unit": {"unit_id"},
+}
+
+// ruleFile is a Prometheus rule file.
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+type rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// runRules prints the rules of the rules command to stdout, and returns the exit code.
+func runRules() int {
+	rules, err := generateRules()
+	if err != nil {
+		slog.Error("cannot generate rules", "err", err)
+		return 1
+	}
+	out, err := yaml.Marshal(rules)
+	if err != nil {
+		slog.Error("cannot marshal rules", "err", err)
+		return 1
+	}
+	fmt.Fprintln(os.Stdout, "# Generated by servertech_exporter rules. Regenerate rather than edit, so the rules match the exporter's metrics.")
+	os.Stdout.Write(out)
+	return 0
+}
+
+// generateRules returns the rules for the metrics of the enabled collectors. Metrics are taken from the collectors'
+// descriptions, so that rules fail to generate rather than silently match nothing if a metric is renamed.
+func generateRules() (*ruleFile, error) {
+	recording := ruleGroup{Name: "servertech.rules"}
+	alerting := ruleGroup{Name: "servertech.alerts"}
+
+	// Overload of entities with a current capacity, alerted on the utilization ratio reported by the PDU. The PDU
+	// does not report the utilization of OCPs, so theirs is derived from their current and capacity. The current and
+	// utilization of the most loaded entity of each cord are recorded, for dashboards of many PDUs.
+	for _, o := range []struct {
+		subsystem string
+		threshold float64
+	}{
+		{"branches", *rulesBranchUtilization},
+		{"lines", *rulesLineUtilization},
+		{"ocps", *rulesOCPUtilization},
+	} {
+		if !collector.Enabled(o.subsystem) {
+			continue
+		}
+		utilization, err := utilizationRatio(o.subsystem)
+		if err != nil {
+			return nil, err
+		}
+		amps, err := lookupMetric(o.subsystem, "amperes")
+		if err != nil {
+			return nil, err
+		}
+		maxAmps, err := aggregate("cord", amps.FQName, "max", amps, selector(amps))
+		if err != nil {
+			return nil, err
+		}
+		maxUtilization, err := aggregate("cord", fmt.Sprintf("servertech_%s_current_utilization_ratio", o.subsystem), "max", amps, utilization)
+		if err != nil {
+			return nil, err
+		}
+		recording.Rules = append(recording.Rules, maxAmps, maxUtilization)
+		alerting.Rules = append(alerting.Rules, newAlert(
+			"ServerTech"+entityNames[o.subsystem]+"Overload",
+			fmt.Sprintf("%s > %g", utilization, o.threshold),
+			fmt.Sprintf("%s of {{ $labels.instance }} is at {{ $value | humanizePercentage }} of its current capacity.", entityDescription(amps)),
+			fmt.Sprintf("%s current has been above %g%% of its current capacity for %s.", entityNames[o.subsystem], o.threshold*100, model.Duration(*rulesFor)),
+		))
+	}
+
+	// Power of each unit, summed over its cords, and as a ratio of their power capacity.
+	if collector.Enabled("cords") {
+		watts, err := lookupMetric("cords", "watts")
+		if err != nil {
+			return nil, err
+		}
+		capacity, err := lookupMetric("cords", "watts_capacity")
+		if err != nil {
+			return nil, err
+		}
+		sumWatts, err := aggregate("unit", watts.FQName, "sum", watts, selector(watts))
+		if err != nil {
+			return nil, err
+		}
+		sumCapacity, err := aggregate("unit", capacity.FQName, "sum", capacity, selector(capacity)+" > 0")
+		if err != nil {
+			return nil, err
+		}
+		recording.Rules = append(recording.Rules, sumWatts, rule{
+			Record: "unit:servertech_cords_power_utilization:ratio",
+			Expr:   sumWatts.Expr + " / " + sumCapacity.Expr,
+		})
+
+		imbalance, err := lookupMetric("cords", "three_phase_imbalance")
+		if err != nil {
+			return nil, err
+		}
+		alerting.Rules = append(alerting.Rules, newAlert(
+			"ServerTechCordPhaseImbalance",
+			fmt.Sprintf("%s > %g", selector(imbalance), *rulesPhaseImbalance),
+			fmt.Sprintf("%s of {{ $labels.instance }} is {{ $value }}%% out of balance across its phases.", entityDescription(imbalance)),
+			fmt.Sprintf("3 phase out of balance percentage has been above %g%% for %s.", *rulesPhaseImbalance, model.Duration(*rulesFor)),
+		))
+	}
+
+	// Statuses that are not normal, of every subsystem with statuses.
+	for _, subsystem := range collector.Subsystems() {
+		if !collector.Enabled(subsystem) {
+			continue
+		}
+		status, ok := collector.LookupMetric(subsystem, "status")
+		if !ok {
+			continue
+		}
+		entity := entityNames[subsystem]
+		if entity == "" {
+			return nil, fmt.Errorf("no entity name for subsystem %q", subsystem)
+		}
+		alerting.Rules = append(alerting.Rules, newAlert(
+			"ServerTech"+entity+"StatusNotNormal",
+			selector(status)+" == 0",
+			fmt.Sprintf("%s of {{ $labels.instance }} has a {{ $labels.status_type }} status that is not normal.", entityDescription(status)),
+			fmt.Sprintf("%s has been not normal for %s.", status.FQName, model.Duration(*rulesFor)),
+		))
+	}
+
+	up, err := lookupMetric("", "collector_up")
+	if err != nil {
+		return nil, err
+	}
+	alerting.Rules = append(alerting.Rules, newAlert(
+		"ServerTechCollectorDown",
+		selector(up)+" == 0",
+		"The {{ $labels.collector }} collector of {{ $labels.instance }} is failing.",
+		fmt.Sprintf("The collector's scrapes have failed for %s. The exporter logs the error of each failed scrape.", model.Duration(*rulesFor)),
+	))
+
+	return &ruleFile{Groups: []ruleGroup{recording, alerting}}, nil
+}
+
+// utilizationRatio returns an expression of the current of the entities of subsystem as a ratio of their current
+// capacity: the exported ratio if the subsystem has one, otherwise derived from the current and capacity.
+func utilizationRatio(subsystem string) (string, error) {
+	if ratio, ok := collector.LookupMetric(subsystem, "current_utilization_ratio"); ok {
+		return selector(ratio), nil
+	}
+	amps, err := lookupMetric(subsystem, "amperes")
+	if err != nil {
+		return "", err
+	}
+	capacity, err := lookupMetric(subsystem, "capacity_amperes")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s / (%s > 0)", selector(amps), selector(capacity)), nil
+}
+
+// aggregate returns a recording rule named level:name:op of the op aggregation of expr, an expression of the metric
+// info, by the job, instance and the aggregation labels of level, which the metric must have.
+func aggregate(level, name, op string, info collector.MetricInfo, expr string) (rule, error) {
+	by := []string{"job", "instance"}
+	for _, label := range aggregationLabels[level] {
+		if !slices.Contains(info.Labels, label) {
+			return rule{}, fmt.Errorf("metric %q has no %q label to aggregate by %s", info.FQName, label, level)
+		}
+		by = append(by, label)
+	}
+	return rule{
+		Record: level + ":" + name + ":" + op,
+		Expr:   fmt.Sprintf("%s by (%s) (%s)", op, strings.Join(by, ", "), expr),
+	}, nil
+}
+
+func lookupMetric(subsystem, name string) (collector.MetricInfo, error) {
+	info, ok := collector.LookupMetric(subsystem, name)
+	if !ok {
+		return info, fmt.Errorf("no description of metric %q of subsystem %q", name, subsystem)
+	}
+	return info, nil
+}
+
+// selector returns the selector of a metric, with the --selector label matchers.
+func selector(info collector.MetricInfo) string {
+	if *rulesSelector == "" {
+		return info.FQName
+	}
+	return info.FQName + "{" + *rulesSelector + "}"
+}
+
+func newAlert(name, expr, summary, description string) rule {
+	return rule{
+		Alert:       name,
+		Expr:        expr,
+		For:         model.Duration(*rulesFor).String(),
+		Labels:      map[string]string{"severity": *rulesSeverity},
+		Annotations: map[string]string{"summary": summary, "description": description},
+	}
+}
+
+// entityDescription returns a template of the description of the entity of a metric, by ID and name if the metric
+// has those labels.
+func entityDescription(info collector.MetricInfo) string {
+	desc := entityNames[info.Subsystem]
+	for _, label := range info.Labels {
+		switch label {
+		case "id":
+			desc += " {{ $labels.id }}"
+		case "name":
+			desc += " ({{ $labels.name }})"
+		}
+	}
+	return desc
+}
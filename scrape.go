@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/tynany/servertech_exporter/collector"
+)
+
+var (
+	scrapeCmd        = kingpin.Command("scrape", "Scrape a PDU once, print its metrics and exit. Exits non-zero if any collector fails.")
+	scrapeTargetName = scrapeCmd.Flag("target", "PDU to scrape.").Required().String()
+	scrapeUser       = scrapeCmd.Flag("user", "PDU username. Taken from the configuration file if not specified.").String()
+	scrapePass       = scrapeCmd.Flag("pass", "PDU password. Taken from the configuration file if not specified.").String()
+	scrapeModule     = scrapeCmd.Flag("module", "Module to scrape the PDU with. Taken from the configuration file if not specified.").String()
+	scrapeCollectors = scrapeCmd.Flag("collector", "Collector to run, may be repeated. All enabled collectors are run if not specified.").Strings()
+	scrapeFormat     = scrapeCmd.Flag("format", "Output format, one of: text (Prometheus text format), json, table.").Default("text").Enum("text", "json", "table")
+)
+
+// runScrape scrapes the target of the scrape command, prints its metrics to stdout, and returns the exit code.
+func runScrape() int {
+	cfg := activeConfig.Load()
+	module, err := cfg.Module(*scrapeModule, *scrapeTargetName)
+	if err != nil {
+		slog.Error("cannot scrape", "err", err)
+		return 2
+	}
+	user, pass := *scrapeUser, *scrapePass
+	if user == "" && pass == "" {
+		if user, pass, err = cfg.Credentials(*scrapeTargetName); err != nil {
+			slog.Error("cannot scrape", "err", err)
+			return 2
+		}
+	}
+
+	exporter := collector.NewExporter(*scrapeTargetName, user, pass, module)
+	if len(*scrapeCollectors) > 0 {
+		collectors := make(map[string]collector.Collector, len(*scrapeCollectors))
+		for _, name := range *scrapeCollectors {
+			c, ok := exporter.Collectors[name]
+			if !ok {
+				slog.Error("unknown or disabled collector", "collector", name)
+				return 2
+			}
+			collectors[name] = c
+		}
+		exporter.Collectors = collectors
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+	families, err := registry.Gather()
+	if err != nil {
+		slog.Error("cannot gather metrics", "err", err)
+		return 1
+	}
+
+	switch *scrapeFormat {
+	case "text":
+		err = writeText(os.Stdout, families)
+	case "json":
+		err = writeScrapeJSON(os.Stdout, families)
+	case "table":
+		err = writeTable(os.Stdout, families)
+	}
+	if err != nil {
+		slog.Error("cannot write metrics", "err", err)
+		return 1
+	}
+
+	status := 0
+	for _, m := range family(families, "servertech_collector_up").GetMetric() {
+		if m.GetGauge().GetValue() != 1 {
+			fmt.Fprintf(os.Stderr, "collector %s failed\n", labelValue(m, "collector"))
+			status = 1
+		}
+	}
+	return status
+}
+
+func writeText(w io.Writer, families []*dto.MetricFamily) error {
+	enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type scrapeMetric struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+type scrapeFamily struct {
+	Name    string         `json:"name"`
+	Help    string         `json:"help"`
+	Type    string         `json:"type"`
+	Metrics []scrapeMetric `json:"metrics"`
+}
+
+func writeScrapeJSON(w io.Writer, families []*dto.MetricFamily) error {
+	out := make([]scrapeFamily, 0, len(families))
+	for _, mf := range families {
+		f := scrapeFamily{Name: mf.GetName(), Help: mf.GetHelp(), Type: strings.ToLower(mf.GetType().String())}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			f.Metrics = append(f.Metrics, scrapeMetric{Labels: labels, Value: metricValue(m)})
+		}
+		out = append(out, f)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// tableColumn is a column of a table of the entities of a subsystem, holding the value of a metric.
+type tableColumn struct {
+	header, metric string
+}
+
+func writeTable(w io.Writer, families []*dto.MetricFamily) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "COLLECTOR\tUP\tDURATION")
+	for _, m := range family(families, "servertech_collector_up").GetMetric() {
+		name := labelValue(m, "collector")
+		duration := ""
+		for _, d := range family(families, "servertech_scrape_duration_seconds").GetMetric() {
+			if labelValue(d, "collector") == name {
+				duration = strconv.FormatFloat(d.GetGauge().GetValue(), 'f', 3, 64) + "s"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", name, metricValue(m) == 1, duration)
+	}
+
+	entityTable(tw, families, "outlets", []tableColumn{
+		{"STATE", "state"}, {"AMPS", "amperes"}, {"VOLTS", "volts"}, {"WATTS", "watts"}, {"KWH", "kilowatthours"},
+	})
+	entityTable(tw, families, "phases", []tableColumn{
+		{"STATE", "state"}, {"VOLTS", "volts"}, {"AMPS", "amperes"}, {"WATTS", "watts"}, {"POWER FACTOR", "power_factor"},
+	})
+
+	// Statuses that are not normal, so problems stand out on PDUs with many entities.
+	fmt.Fprintln(tw, "\nSUBSYSTEM\tID\tSTATUS TYPE\tSTATUS")
+	abnormal := 0
+	for _, subsystem := range collector.Subsystems() {
+		for _, m := range family(families, "servertech_"+subsystem+"_status").GetMetric() {
+			if metricValue(m) != 1 {
+				fmt.Fprintf(tw, "%s\t%s\t%s\tnot normal\n", subsystem, labelValue(m, "id"), labelValue(m, "status_type"))
+				abnormal++
+			}
+		}
+	}
+	if abnormal == 0 {
+		fmt.Fprintln(tw, "(all statuses normal)")
+	}
+	return tw.Flush()
+}
+
+// entityTable writes a table of the entities of subsystem, with the value of a metric in each column. State is
+// written as on or off.
+func entityTable(w io.Writer, families []*dto.MetricFamily, subsystem string, columns []tableColumn) {
+	info := family(families, "servertech_"+subsystem+"_info")
+	if info == nil {
+		return
+	}
+	fmt.Fprintf(w, "\n%s\tNAME", strings.ToUpper(subsystem))
+	for _, c := range columns {
+		fmt.Fprintf(w, "\t%s", c.header)
+	}
+	fmt.Fprintln(w)
+
+	values := make(map[string]map[string]float64)
+	for _, c := range columns {
+		values[c.metric] = make(map[string]float64)
+		for _, m := range family(families, "servertech_"+subsystem+"_"+c.metric).GetMetric() {
+			values[c.metric][labelValue(m, "id")] = metricValue(m)
+		}
+	}
+
+	entities := info.GetMetric()
+	sort.SliceStable(entities, func(i, j int) bool { return labelValue(entities[i], "id") < labelValue(entities[j], "id") })
+	for _, m := range entities {
+		id := labelValue(m, "id")
+		fmt.Fprintf(w, "%s\t%s", id, labelValue(m, "name"))
+		for _, c := range columns {
+			v, ok := values[c.metric][id]
+			switch {
+			case !ok:
+				fmt.Fprint(w, "\t-")
+			case c.metric == "state" && v == 1:
+				fmt.Fprint(w, "\ton")
+			case c.metric == "state":
+				fmt.Fprint(w, "\toff")
+			default:
+				fmt.Fprintf(w, "\t%s", strconv.FormatFloat(v, 'f', -1, 64))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func family(families []*dto.MetricFamily, name string) *dto.MetricFamily {
+	for _, mf := range families {
+		if mf.GetName() == name {
+			return mf
+		}
+	}
+	return nil
+}
+
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.GetGauge() != nil:
+		return m.GetGauge().GetValue()
+	case m.GetCounter() != nil:
+		return m.GetCounter().GetValue()
+	default:
+		return m.GetUntyped().GetValue()
+	}
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
@@ -1,14 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"log/slog"
 	"net/http"
+	"os"
 
+	kingpin "github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
+	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/common/log"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
+	promslogflag "github.com/prometheus/common/promslog/flag"
 	"github.com/prometheus/common/version"
-	"github.com/tynany/servertech_exporter/collector"
-	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	"github.com/tynany/servertech_exporter/influx"
+	"github.com/tynany/servertech_exporter/modbus"
+	"github.com/tynany/servertech_exporter/mqtt"
+	"github.com/tynany/servertech_exporter/otlp"
+	"github.com/tynany/servertech_exporter/poll"
+	"github.com/tynany/servertech_exporter/remotewrite"
 )
 
 var (
@@ -17,69 +29,227 @@ var (
 	httpOnly      = kingpin.Flag("web.http", "Run in HTTP mode.").Default("False").Bool()
 	sslCrt        = kingpin.Flag("web.certificate", "Path to SSL certificate.").String()
 	sslKey        = kingpin.Flag("web.key", "Path to SSL certificate key.").String()
+	serveCmd      = kingpin.Command("serve", "Serve metrics (default).").Default()
+
+	configFile = kingpin.Flag("config.file", "Path to the servertech_exporter configuration file.").String()
 )
 
 func handler(w http.ResponseWriter, r *http.Request) {
-	target := r.URL.Query().Get("target")
-	user := r.URL.Query().Get("user")
-	pass := r.URL.Query().Get("pass")
-	if target == "" {
-		http.Error(w, "'target' parameter must be specified", 400)
+	t, err := resolveTarget(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
 		return
 	}
 
 	registry := prometheus.NewRegistry()
+	if err := prometheus.WrapRegistererWith(t.labels, registry).Register(t.newExporter(r)); err != nil {
+		requestLogger(r).Error("cannot register exporter", "target", t.target, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	registry.Register(collector.NewExporter(target, user, pass))
-
-	gatheres := prometheus.Gatherers{
+	gatheres := unitPreservingGatherers{
 		prometheus.DefaultGatherer,
 		registry,
 	}
 	handlerOpts := promhttp.HandlerOpts{
-		ErrorLog:      log.NewErrorLogger(),
-		ErrorHandling: promhttp.ContinueOnError,
+		ErrorLog:                            slog.NewLogLogger(requestLogger(r).With("target", t.target).Handler(), slog.LevelError),
+		ErrorHandling:                       promhttp.ContinueOnError,
+		EnableOpenMetrics:                   true,
+		EnableOpenMetricsTextCreatedSamples: true,
 	}
 	promhttp.HandlerFor(gatheres, handlerOpts).ServeHTTP(w, r)
 }
 
-func parseCLI() {
-	log.AddFlags(kingpin.CommandLine)
+// unitPreservingGatherers merges metric families like prometheus.Gatherers, but keeps their units, which
+// prometheus.Gatherers drops.
+type unitPreservingGatherers prometheus.Gatherers
+
+// Gather implements prometheus.Gatherer.
+func (gs unitPreservingGatherers) Gather() ([]*dto.MetricFamily, error) {
+	units := make(map[string]*string)
+	gatherers := make(prometheus.Gatherers, len(gs))
+	for i, g := range gs {
+		g := g
+		gatherers[i] = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			mfs, err := g.Gather()
+			for _, mf := range mfs {
+				if mf.Unit != nil {
+					units[mf.GetName()] = mf.Unit
+				}
+			}
+			return mfs, err
+		})
+	}
+	mfs, err := gatherers.Gather()
+	for _, mf := range mfs {
+		mf.Unit = units[mf.GetName()]
+	}
+	return mfs, err
+}
+
+// parseCLI parses the command line and loads the configuration file, returning the command to run.
+func parseCLI() string {
+	promslogConfig := &promslog.Config{}
+	promslogflag.AddFlags(kingpin.CommandLine, promslogConfig)
 	kingpin.Version(version.Print("servertech_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
-	if !*httpOnly {
+	command := kingpin.Parse()
+	slog.SetDefault(slog.New(newRepeatHandler(promslog.New(promslogConfig).Handler(), *logRepeatInterval)))
+	// The certificate may instead be in the web config file, which is checked when serving.
+	if command == serveCmd.FullCommand() && !*httpOnly && *webConfigFile == "" {
 		if *sslCrt == "" || *sslKey == "" {
-			log.Fatal("HTTPS mode selected but SSL certificate and key not specified")
+			fatal("HTTPS mode selected but SSL certificate and key not specified")
 		}
 	}
+	// The check command reports configuration errors rather than exiting, and rules do not depend on it.
+	if command != checkCmd.FullCommand() && command != rulesCmd.FullCommand() {
+		if err := reloadConfig(); err != nil {
+			fatal("cannot load config", "err", err)
+		}
+	}
+	return command
 }
 
 func main() {
-	prometheus.MustRegister(version.NewCollector("servertech_exporter"))
+	prometheus.MustRegister(versioncollector.NewCollector("servertech_exporter"))
 
-	parseCLI()
+	switch parseCLI() {
+	case scrapeCmd.FullCommand():
+		os.Exit(runScrape())
+	case checkCmd.FullCommand():
+		os.Exit(runCheck())
+	case rulesCmd.FullCommand():
+		os.Exit(runRules())
+	}
 
-	log.Infof("Starting servertech_exporter %s on %s", version.Info(), *listenAddress)
+	slog.Info("Starting servertech_exporter", "version", version.Info(), "address", *listenAddress)
+	go reloadOnSignal()
 
 	http.HandleFunc(*telemetryPath, handler)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-			<head><title>ServerTech Exporter</title></head>
-			<body>
-			<h1>ServerTech Exporter</h1>
-			<p><a href="` + *telemetryPath + `">Metrics</a></p>
-			</body>
-			</html>`))
-	})
+	http.HandleFunc("/api/v1/topology", topologyHandler)
+	http.HandleFunc("/api/v1/readings", readingsHandler)
+	http.HandleFunc("/api/v1/influx", influxHandler)
+	http.HandleFunc("/api/v1/sd", sdHandler)
+	http.HandleFunc("/api/v1/config", configHandler)
+	http.HandleFunc("/-/reload", reloadHandler)
+	http.HandleFunc(healthyPath, healthyHandler)
+	http.HandleFunc(readyPath, readyHandler)
+	http.HandleFunc("/api/v1/scrapes", scrapesHandler)
+	http.HandleFunc("/ui/pdu", pduHandler)
+	if *controlEnabled {
+		ctrl, err := newControlHandler()
+		if err != nil {
+			fatal("cannot enable outlet power control", "err", err)
+		}
+		http.Handle(controlPath, ctrl)
+	}
+	var stopPolling func(ctx context.Context)
+	if poll.Enabled() {
+		stopPolling = startPolling()
+	}
+	http.HandleFunc("/", statusHandler)
+
+	webCfg, err := loadWebConfig(*webConfigFile)
+	if err != nil {
+		fatal("cannot load web config", "err", err)
+	}
+	server := &http.Server{Addr: *listenAddress, Handler: &logHandler{handler: &webHandler{handler: http.DefaultServeMux}}}
+	if http2 := webCfg.HTTPConfig.HTTP2; http2 != nil && !*http2 {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	shutdown := make(chan struct{})
+	go func() {
+		shutdownOnSignal(server, stopPolling)
+		close(shutdown)
+	}()
 
 	if *httpOnly {
-		if err := http.ListenAndServe(*listenAddress, nil); err != nil {
-			log.Fatal(err)
+		if webCfg.TLSConfig != nil {
+			fatal("tls_server_config in the web config file cannot be used in HTTP mode")
+		}
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			fatal("cannot serve http", "err", err)
 		}
 	} else {
-		if err := http.ListenAndServeTLS(*listenAddress, *sslCrt, *sslKey, nil); err != nil {
-			log.Fatal(err)
+		controlCAFile := ""
+		if *controlEnabled {
+			controlCAFile = *controlClientCA
 		}
+		server.TLSConfig, err = webServerTLSConfig(controlCAFile)
+		if err != nil {
+			fatal("cannot configure tls", "err", err)
+		}
+		if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			fatal("cannot serve https", "err", err)
+		}
+	}
+	<-shutdown
+}
+
+// startPolling starts background polling, writing to the enabled outputs. It returns a function that stops polling,
+// waiting for the poll in progress and then flushing the outputs until ctx is done. The outputs are not flushed if the
+// poll in progress does not finish in time, as it may still write to them.
+func startPolling() func(ctx context.Context) {
+	var sinks []poll.Sink
+	if remotewrite.Enabled() {
+		sink, err := remotewrite.New()
+		if err != nil {
+			fatal("cannot enable remote_write", "err", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if influx.Enabled() {
+		sink, err := influx.New()
+		if err != nil {
+			fatal("cannot enable influxdb output", "err", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if mqtt.Enabled() {
+		sink, err := mqtt.New()
+		if err != nil {
+			fatal("cannot enable mqtt output", "err", err)
+		}
+		sinks = append(sinks, sink)
 	}
+	if modbus.Enabled() {
+		sink, err := modbus.New()
+		if err != nil {
+			fatal("cannot enable modbus server", "err", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if otlp.Enabled() {
+		sink, err := otlp.New()
+		if err != nil {
+			fatal("cannot enable otlp output", "err", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		fatal("background polling enabled but no output enabled")
+	}
+	pollCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		poll.Run(pollCtx, activeConfig.Load, sinks...)
+		close(done)
+	}()
+	return func(ctx context.Context) {
+		cancel()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			slog.Error("poll in progress did not finish, outputs not flushed", "err", ctx.Err())
+			return
+		}
+		poll.Close(ctx, sinks...)
+	}
+}
+
+// fatal logs msg at the error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/version"
+	"github.com/tynany/servertech_exporter/collector"
+)
+
+// statusRecentScrapes is the number of recent scrapes of each target shown on the status page.
+const statusRecentScrapes = 10
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		return time.Since(t).Truncate(time.Second).String() + " ago"
+	},
+	"seconds": func(d time.Duration) string {
+		return d.Truncate(time.Millisecond).String()
+	},
+}).Parse(`<html>
+	<head>
+	<title>ServerTech Exporter</title>
+	<style>
+	body { font-family: sans-serif; }
+	table { border-collapse: collapse; }
+	th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+	.ok { color: #080; }
+	.failed { color: #c00; }
+	.never { color: #888; }
+	</style>
+	</head>
+	<body>
+	<h1>ServerTech Exporter</h1>
+	<p><a href="{{.TelemetryPath}}">Metrics</a> &middot; <a href="/api/v1/scrapes">Recent scrapes (JSON)</a> &middot; Version {{.Version}}</p>
+	<h2>Targets</h2>
+	{{if .Targets}}
+	<table>
+	<tr><th>Target</th><th>Last scrape</th><th>Duration</th><th>Firmware</th><th>Collectors</th><th>Recent scrapes</th><th></th></tr>
+	{{range .Targets}}
+	<tr>
+	<td>{{.Name}}</td>
+	{{with .Last}}
+	<td title="{{.Time.Format "2006-01-02T15:04:05Z07:00"}}">{{ago .Time}}</td>
+	<td>{{seconds .Duration}}</td>
+	<td>{{.Firmware}}</td>
+	<td>{{range .Collectors}}{{if .Success}}<span class="ok">{{.Name}}</span> {{seconds .Duration}}{{else}}<span class="failed">{{.Name}}</span> {{seconds .Duration}}: {{.Error}}{{end}}<br>{{end}}</td>
+	{{else}}
+	<td class="never" colspan="4">not scraped recently</td>
+	{{end}}
+	<td>{{range .Recent}}{{if .Success}}<span class="ok" title="{{ago .Time}}">&#10003;</span>{{else}}<span class="failed" title="{{ago .Time}}">&#10007;</span>{{end}}{{end}}</td>
+	<td><a href="/ui/pdu?target={{.Name}}">outlet map</a> <a href="{{$.TelemetryPath}}?target={{.Name}}">metrics</a> <a href="/api/v1/readings?target={{.Name}}">readings</a> <a href="/api/v1/scrapes?target={{.Name}}">raw</a></td>
+	</tr>
+	{{end}}
+	</table>
+	{{else}}
+	<p>No targets configured or scraped recently.</p>
+	{{end}}
+	</body>
+	</html>
+`))
+
+// statusTarget is a target listed on the status page.
+type statusTarget struct {
+	Name string
+	// Last scrape of the target, nil if not scraped recently.
+	Last *collector.ScrapeResult
+	// Recent scrapes of the target, oldest first.
+	Recent []collector.ScrapeResult
+}
+
+// statusHandler returns a page of the configured targets and those scraped recently, with the outcome of their
+// recent scrapes.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	targets := make(map[string]*statusTarget)
+	if cfg := activeConfig.Load(); cfg != nil {
+		for _, t := range cfg.Targets {
+			if t.Name != "" {
+				targets[t.Name] = &statusTarget{Name: t.Name}
+			}
+		}
+	}
+	for _, result := range collector.RecentScrapes() {
+		t, ok := targets[result.Target]
+		if !ok {
+			t = &statusTarget{Name: result.Target}
+			targets[result.Target] = t
+		}
+		t.Recent = append(t.Recent, result)
+	}
+
+	data := struct {
+		TelemetryPath, Version string
+		Targets                []*statusTarget
+	}{TelemetryPath: *telemetryPath, Version: version.Version}
+	for _, t := range targets {
+		if len(t.Recent) > statusRecentScrapes {
+			t.Recent = t.Recent[len(t.Recent)-statusRecentScrapes:]
+		}
+		if len(t.Recent) > 0 {
+			t.Last = &t.Recent[len(t.Recent)-1]
+		}
+		data.Targets = append(data.Targets, t)
+	}
+	sort.Slice(data.Targets, func(i, j int) bool { return data.Targets[i].Name < data.Targets[j].Name })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, data); err != nil {
+		slog.Error("cannot write status page", "err", err)
+	}
+}
+
+// scrapesHandler returns the recent scrape results kept for the status page as JSON, oldest first, optionally only
+// those of the 'target' parameter.
+func scrapesHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	results := []collector.ScrapeResult{}
+	for _, result := range collector.RecentScrapes() {
+		if target == "" || result.Target == target {
+			results = append(results, result)
+		}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
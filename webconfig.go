@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// maxAuthCacheSize is the number of successful basic authentications cached, so that bcrypt hashes are not computed
+// on every request.
+const maxAuthCacheSize = 100
+
+var (
+	webConfigFile = kingpin.Flag("web.config.file", "Path to a web configuration file, in the exporter-toolkit format, enabling TLS options, client certificate verification and basic authentication. Reloaded on every connection and request.").String()
+
+	// dummyHash is compared against for unknown users, so that they take as long to reject as known users.
+	dummyHash = []byte("$2y$10$QOauhQNbBCuQDKes6eFzPeMqBSjb7Mr5DUmpZ/VcEd00UAV/LDeSi")
+
+	tlsVersions = map[string]uint16{
+		"TLS13": tls.VersionTLS13,
+		"TLS12": tls.VersionTLS12,
+		"TLS11": tls.VersionTLS11,
+		"TLS10": tls.VersionTLS10,
+	}
+	curves = map[string]tls.CurveID{
+		"CurveP256": tls.CurveP256,
+		"CurveP384": tls.CurveP384,
+		"CurveP521": tls.CurveP521,
+		"X25519":    tls.X25519,
+	}
+	clientAuthTypes = map[string]tls.ClientAuthType{
+		"":                           tls.NoClientCert,
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"RequireClientCert":          tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+)
+
+// webConfig is the web configuration file, in the exporter-toolkit format.
+type webConfig struct {
+	TLSConfig  *webTLSConfig     `yaml:"tls_server_config"`
+	HTTPConfig webHTTPConfig     `yaml:"http_server_config"`
+	Users      map[string]string `yaml:"basic_auth_users"`
+}
+
+type webTLSConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	Cert                     string   `yaml:"cert"`
+	Key                      string   `yaml:"key"`
+	ClientAuth               string   `yaml:"client_auth_type"`
+	ClientCAFile             string   `yaml:"client_ca_file"`
+	ClientAllowedSans        []string `yaml:"client_allowed_sans"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	PreferServerCipherSuites bool     `yaml:"prefer_server_cipher_suites"`
+}
+
+type webHTTPConfig struct {
+	HTTP2   *bool             `yaml:"http2"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// loadWebConfig loads the web configuration file at path, or returns an empty configuration if path is empty. Paths
+// in the file are relative to its directory.
+func loadWebConfig(path string) (*webConfig, error) {
+	c := &webConfig{}
+	if path == "" {
+		return c, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read web config file: %v", err)
+	}
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return nil, fmt.Errorf("cannot parse web config file %q: %v", path, err)
+	}
+	for user, hash := range c.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid web config file %q: basic auth user %q does not have a bcrypt password hash: %v", path, user, err)
+		}
+	}
+	if t := c.TLSConfig; t != nil {
+		dir := filepath.Dir(path)
+		for _, p := range []*string{&t.CertFile, &t.KeyFile, &t.ClientCAFile} {
+			if *p != "" && !filepath.IsAbs(*p) {
+				*p = filepath.Join(dir, *p)
+			}
+		}
+	}
+	return c, nil
+}
+
+// tlsConfig returns the TLS configuration of the web server. The certificate is taken from --web.certificate and
+// --web.key if not in the web configuration file. Client certificates signed by the CAs in controlCAFile, if not
+// empty, are verified if given, for the outlet power control API.
+func (c *webConfig) tlsConfig(controlCAFile string) (*tls.Config, error) {
+	t := c.TLSConfig
+	if t == nil {
+		t = &webTLSConfig{}
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	var (
+		cert tls.Certificate
+		err  error
+	)
+	switch {
+	case t.Cert != "" || t.Key != "":
+		cert, err = tls.X509KeyPair([]byte(t.Cert), []byte(t.Key))
+	case t.CertFile != "" || t.KeyFile != "":
+		cert, err = tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	case *sslCrt != "" && *sslKey != "":
+		cert, err = tls.LoadX509KeyPair(*sslCrt, *sslKey)
+	default:
+		return nil, fmt.Errorf("HTTPS mode selected but SSL certificate and key not specified")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS certificate: %v", err)
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+
+	if t.MinVersion != "" {
+		if cfg.MinVersion, err = tlsVersion(t.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+	if t.MaxVersion != "" {
+		if cfg.MaxVersion, err = tlsVersion(t.MaxVersion); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range t.CipherSuites {
+		id, err := cipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	for _, name := range t.CurvePreferences {
+		id, ok := curves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+	}
+
+	clientAuth, ok := clientAuthTypes[t.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %q", t.ClientAuth)
+	}
+	if t.ClientCAFile == "" && (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) {
+		return nil, fmt.Errorf("client_auth_type %q requires client_ca_file", t.ClientAuth)
+	}
+	// The control API verifies client certificates against its own CAs, so certificates signed by client_ca_file
+	// are not authorized to control outlets.
+	var caFiles []string
+	for _, f := range []string{t.ClientCAFile, controlCAFile} {
+		if f != "" {
+			caFiles = append(caFiles, f)
+		}
+	}
+	if len(caFiles) > 0 {
+		if cfg.ClientCAs, err = loadCertPool(caFiles...); err != nil {
+			return nil, err
+		}
+	}
+	if controlCAFile != "" && (clientAuth == tls.NoClientCert || clientAuth == tls.RequestClientCert) {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+	cfg.ClientAuth = clientAuth
+
+	if len(t.ClientAllowedSans) > 0 {
+		allowed := t.ClientAllowedSans
+		cfg.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if len(chains) == 0 || len(chains[0]) == 0 {
+				return nil
+			}
+			cert := chains[0][0]
+			sans := append(append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...), cert.Subject.CommonName)
+			for _, ip := range cert.IPAddresses {
+				sans = append(sans, ip.String())
+			}
+			for _, uri := range cert.URIs {
+				sans = append(sans, uri.String())
+			}
+			for _, san := range sans {
+				for _, a := range allowed {
+					if san == a {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("client certificate SAN is not in client_allowed_sans")
+		}
+	}
+	return cfg, nil
+}
+
+func tlsVersion(name string) (uint16, error) {
+	v, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", name)
+	}
+	return v, nil
+}
+
+func cipherSuite(name string) (uint16, error) {
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if s.Name == name {
+			return s.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+// loadCertPool returns a pool of the CA certificates in the PEM files at paths.
+func loadCertPool(paths ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, path := range paths {
+		caPEM, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA certificates: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %q", path)
+		}
+	}
+	return pool, nil
+}
+
+// webServerTLSConfig returns the TLS configuration of the web server, loading the web configuration file on every
+// connection. It fails if the TLS configuration is invalid when called, so that errors are found at startup.
+func webServerTLSConfig(controlCAFile string) (*tls.Config, error) {
+	c, err := loadWebConfig(*webConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.tlsConfig(controlCAFile); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := loadWebConfig(*webConfigFile)
+			if err != nil {
+				slog.Error("cannot load web config", "err", err)
+				return nil, err
+			}
+			cfg, err := c.tlsConfig(controlCAFile)
+			if err != nil {
+				slog.Error("cannot configure tls", "err", err)
+			}
+			return cfg, err
+		},
+	}, nil
+}
+
+// webHandler requires basic authentication of requests, if users are configured in the web configuration file, and
+// sets its headers. The outlet power control API has its own authentication, and the health and readiness endpoints
+// are used by probes that cannot authenticate, so neither require basic authentication.
+type webHandler struct {
+	handler http.Handler
+
+	mu        sync.Mutex
+	authCache map[[sha256.Size]byte]bool
+}
+
+func (h *webHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := loadWebConfig(*webConfigFile)
+	if err != nil {
+		slog.Error("cannot load web config", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	for k, v := range c.HTTPConfig.Headers {
+		w.Header().Set(k, v)
+	}
+	if len(c.Users) > 0 && !strings.HasPrefix(r.URL.Path, controlPath) && r.URL.Path != healthyPath && r.URL.Path != readyPath {
+		user, pass, ok := r.BasicAuth()
+		if !ok || !h.authenticate(c.Users, user, pass) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="servertech_exporter"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+func (h *webHandler) authenticate(users map[string]string, user, pass string) bool {
+	hash, known := users[user]
+	if !known {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(pass))
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + pass))
+	h.mu.Lock()
+	cached := h.authCache[key]
+	h.mu.Unlock()
+	if cached {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.authCache == nil || len(h.authCache) >= maxAuthCacheSize {
+		h.authCache = make(map[[sha256.Size]byte]bool)
+	}
+	h.authCache[key] = true
+	return true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := map[string]string{"prometheus": string(hash)}
+	h := &webHandler{}
+
+	for _, test := range []struct {
+		name, user, pass string
+		authenticated    bool
+		cached           int
+	}{
+		{name: "unknown user", user: "admin", pass: "secret"},
+		{name: "wrong password", user: "prometheus", pass: "wrong"},
+		{name: "correct password", user: "prometheus", pass: "secret", authenticated: true, cached: 1},
+		{name: "cached", user: "prometheus", pass: "secret", authenticated: true, cached: 1},
+		{name: "wrong password after cached", user: "prometheus", pass: "secrets", cached: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if ok := h.authenticate(users, test.user, test.pass); ok != test.authenticated {
+				t.Errorf("expected authenticated %v, got %v", test.authenticated, ok)
+			}
+			if len(h.authCache) != test.cached {
+				t.Errorf("expected %d cached authentications, got %d", test.cached, len(h.authCache))
+			}
+		})
+	}
+}
+
+func TestAuthenticateCacheKey(t *testing.T) {
+	// The hash is not valid bcrypt, so the user can only be authenticated from the cache.
+	users := map[string]string{"prometheus": "cached"}
+	h := &webHandler{authCache: map[[sha256.Size]byte]bool{
+		sha256.Sum256([]byte("prometheus\x00cached\x00secret")): true,
+	}}
+	if !h.authenticate(users, "prometheus", "secret") {
+		t.Error("expected cached authentication to be used")
+	}
+
+	// Changing the hash of a user, e.g. to change their password, invalidates their cached authentications.
+	hash, err := bcrypt.GenerateFromPassword([]byte("changed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users["prometheus"] = string(hash)
+	if h.authenticate(users, "prometheus", "secret") {
+		t.Error("expected authentication with the old password to fail")
+	}
+	if !h.authenticate(users, "prometheus", "changed") {
+		t.Error("expected authentication with the new password to succeed")
+	}
+}
+
+func TestAuthenticateCacheBounded(t *testing.T) {
+	users := make(map[string]string)
+	h := &webHandler{authCache: make(map[[sha256.Size]byte]bool)}
+	for i := 0; i < maxAuthCacheSize; i++ {
+		users[strconv.Itoa(i)] = "cached"
+		h.authCache[sha256.Sum256([]byte(strconv.Itoa(i)+"\x00cached\x00secret"))] = true
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users["prometheus"] = string(hash)
+
+	// The cache is reset when full, rather than growing with the number of users and passwords.
+	if !h.authenticate(users, "prometheus", "secret") {
+		t.Fatal("expected authentication to succeed")
+	}
+	if len(h.authCache) != 1 {
+		t.Errorf("expected 1 cached authentication, got %d", len(h.authCache))
+	}
+}